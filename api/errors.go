@@ -0,0 +1,66 @@
+package api
+
+// ErrorCode identifies the reason of an error response. Codes are stable, and
+// unlike the accompanying messages meant to be matched on by clients.
+type ErrorCode string
+
+// Request errors.
+const (
+	CodeInvalidRequest      ErrorCode = "invalid_request"
+	CodeInvalidCapabilities ErrorCode = "invalid_capabilities"
+	CodeInvalidIdentityKey  ErrorCode = "invalid_identity_key"
+	CodeInvalidSignature    ErrorCode = "invalid_signature"
+	CodeTooLarge            ErrorCode = "too_large"
+)
+
+// Authentication errors. Requests failing with these may succeed after
+// logging in again.
+const (
+	CodeAuthFailed          ErrorCode = "auth_failed"
+	CodeAuthRateLimited     ErrorCode = "auth_rate_limited"
+	CodeNoSession           ErrorCode = "no_session"
+	CodeSessionExpired      ErrorCode = "session_expired"
+	CodeRefreshTokenInvalid ErrorCode = "refresh_token_invalid"
+	CodeRefreshTokenReused  ErrorCode = "refresh_token_reused"
+)
+
+// Authorization errors.
+const (
+	CodeAccessDenied         ErrorCode = "access_denied"
+	CodeCapabilityMissing    ErrorCode = "capability_missing"
+	CodeCapabilityNotGranted ErrorCode = "capability_not_granted"
+	CodeSharingNotAllowed    ErrorCode = "sharing_not_allowed"
+	CodeNotOwner             ErrorCode = "not_owner"
+	CodeNotMember            ErrorCode = "not_member"
+	CodeNotInvited           ErrorCode = "not_invited"
+)
+
+// Errors for missing entities.
+const (
+	CodeNoSuchUser    ErrorCode = "no_such_user"
+	CodeNoSuchSession ErrorCode = "no_such_session"
+	CodeNoSuchDevice  ErrorCode = "no_such_device"
+	CodeNoSuchGroup   ErrorCode = "no_such_group"
+	CodeNoSuchContact ErrorCode = "no_such_contact"
+	CodeNoSuchRequest ErrorCode = "no_such_request"
+	CodeNoSuchKey     ErrorCode = "no_such_key"
+	CodeNoIdentityKey ErrorCode = "no_identity_key"
+	CodeNoPrekeys     ErrorCode = "no_prekeys"
+	CodeNotBlocked    ErrorCode = "not_blocked"
+)
+
+// Errors for conflicting state.
+const (
+	CodeUserExists    ErrorCode = "user_exists"
+	CodeKeyIDInUse    ErrorCode = "key_id_in_use"
+	CodeAlreadyMember ErrorCode = "already_member"
+)
+
+// Errors for exhausted limits.
+const (
+	CodeRateLimited   ErrorCode = "rate_limited"
+	CodeQuotaExceeded ErrorCode = "quota_exceeded"
+)
+
+// CodeInternal is a failure of the server.
+const CodeInternal ErrorCode = "internal_error"
@@ -0,0 +1,83 @@
+// Package api holds the routes and the request and response types of the
+// HTTP API, shared by the server and client packages.
+package api
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// Top-level routes.
+const (
+	AuthRoute  = "/auth"
+	UserRoute  = "/user"
+	GroupRoute = "/group"
+	StatsRoute = "/stats"
+	AckRoute   = "/ack"
+
+	WSRoute   = "/ws"
+	SSERoute  = "/sse"
+	PollRoute = "/poll"
+)
+
+// Routes below AuthRoute.
+const (
+	AuthRefresh = "/refresh"
+	AuthCert    = "/cert"
+)
+
+// Routes below UserRoute followed by a username.
+const (
+	UserPassword     = "/password"
+	UserIdentity     = "/identity"
+	UserTemporaryKey = "/temporaryKey"
+	UserOneTimeKey   = "/oneTimeKey"
+	UserOneTimeKeys  = "/oneTimekeys"
+	UserMessage      = "/message"
+	UserSharing      = "/sharing"
+	UserContacts     = "/contacts"
+	UserBlocks       = "/blocks"
+	UserDevices      = "/devices"
+	UserStats        = "/stats"
+	UserSessions     = "/sessions"
+)
+
+// Routes below GroupRoute followed by a group ID.
+const (
+	GroupMember  = "/member"
+	GroupMessage = "/message"
+)
+
+// SubscribeRoute is the route below WSRoute, SSERoute and PollRoute.
+const SubscribeRoute = "/subscribe"
+
+// Root is the route of a resource itself, below its parameter.
+const Root = "/"
+
+// Param returns a path segment holding a route parameter.
+func Param(v string) string {
+	return "/" + url.PathEscape(v)
+}
+
+// ParamUint returns a path segment holding a numeric route parameter.
+func ParamUint(v uint64) string {
+	return "/" + strconv.FormatUint(v, 10)
+}
+
+// UserPath returns the path of a route below the named user.
+func UserPath(username string, route ...string) string {
+	p := UserRoute + Param(username)
+	for _, r := range route {
+		p += r
+	}
+	return p
+}
+
+// GroupPath returns the path of a route below the group with the given ID.
+func GroupPath(id string, route ...string) string {
+	p := GroupRoute + Param(id)
+	for _, r := range route {
+		p += r
+	}
+	return p
+}
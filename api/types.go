@@ -0,0 +1,202 @@
+package api
+
+import "time"
+
+// AuthorizationScheme prefixes session tokens in the Authorization header.
+const AuthorizationScheme = "LOCSHARE"
+
+// TTLHeader lets publishers set how long a message stays deliverable, in
+// seconds.
+const TTLHeader = "X-Locshare-TTL"
+
+// Message kinds. Messages are opaque content from publishers, events are
+// generated by the server, and gaps tell a resuming subscriber that the
+// messages in the range held in their content have been lost.
+const (
+	KindMessage = "message"
+	KindEvent   = "event"
+	KindGap     = "gap"
+)
+
+// Group events, sent to members as KindEvent messages holding a GroupEvent.
+const (
+	GroupEventInvited = "invited"
+	GroupEventJoined  = "joined"
+	GroupEventLeft    = "left"
+	GroupEventDeleted = "deleted"
+)
+
+type ErrorResp struct {
+	Status string    `json:"status"`
+	Code   ErrorCode `json:"code"`
+	Error  string    `json:"error"`
+}
+
+// OKResp is the response of requests that have nothing else to return.
+type OKResp struct {
+	Status string `json:"status"`
+}
+
+type AuthReq struct {
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	Capabilities []string `json:"capabilities"`
+	Refresh      bool     `json:"refresh"`
+}
+
+// AuthResp is returned by logins and refreshes. RefreshToken is only set for
+// logins asking for one, and by refreshes.
+type AuthResp struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+type RefreshReq struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type Session struct {
+	ID           string    `json:"id"`
+	Capabilities []string  `json:"capabilities"`
+	Created      time.Time `json:"created"`
+	LastUsed     time.Time `json:"lastUsed"`
+	Current      bool      `json:"current"`
+}
+
+type SessionsResp struct {
+	Sessions []Session `json:"sessions"`
+}
+
+type NewUserReq struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+}
+
+type PasswordReq struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// TemporaryKeyReq uploads a signed prekey. Signature is the signature of Key
+// by the identity key of the user; see package prekey.
+type TemporaryKeyReq struct {
+	Key       []byte `json:"key"`
+	Signature []byte `json:"signature"`
+}
+
+// KeyResp holds a temporary or one-time key. Temporary keys come with their
+// signature by the identity key of the user.
+type KeyResp struct {
+	KeyID     uint64 `json:"keyID"`
+	Key       []byte `json:"key"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+type OneTimeKeysResp struct {
+	Keys []uint64 `json:"keys"`
+}
+
+type SharingResp struct {
+	Accepted []string `json:"accepted"`
+	Pending  []string `json:"pending"`
+}
+
+type Contact struct {
+	Username string `json:"username"`
+	State    string `json:"state"`
+	Incoming bool   `json:"incoming,omitempty"`
+
+	// CanSee tells if the user accepts locations from the contact, and
+	// CanSeeMe if the contact accepts locations from the user.
+	CanSee   bool `json:"canSee"`
+	CanSeeMe bool `json:"canSeeMe"`
+}
+
+type ContactsResp struct {
+	Contacts []Contact `json:"contacts"`
+}
+
+type BlocksResp struct {
+	Blocked []string `json:"blocked"`
+}
+
+type Device struct {
+	ID     string `json:"id"`
+	Queued int    `json:"queued"`
+	Cursor uint64 `json:"cursor"`
+	Online bool   `json:"online"`
+}
+
+type DevicesResp struct {
+	Devices []Device `json:"devices"`
+}
+
+// Stats counts the messages of a user.
+type Stats struct {
+	Queued  int    `json:"queued"`
+	History int    `json:"history"`
+	Expired uint64 `json:"expired"`
+	Bytes   int    `json:"bytes"`
+}
+
+// ServerStats counts the messages of all users.
+type ServerStats struct {
+	Users int `json:"users"`
+	Stats
+}
+
+type Group struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+	Invited []string `json:"invited"`
+}
+
+type GroupsResp struct {
+	Groups []Group `json:"groups"`
+}
+
+type NewGroupReq struct {
+	Name string `json:"name"`
+}
+
+type GroupEvent struct {
+	Group  string `json:"group"`
+	Event  string `json:"event"`
+	Member string `json:"member,omitempty"`
+}
+
+// GroupMessageReq carries one separately encrypted copy of a message for each
+// recipient.
+type GroupMessageReq struct {
+	Recipients map[string][]byte `json:"recipients"`
+	// TTL is the time-to-live of the message in seconds, as with the
+	// TTLHeader of single messages.
+	TTL uint64 `json:"ttl,omitempty"`
+}
+
+type GroupMessageResp struct {
+	Delivered []string          `json:"delivered"`
+	Failed    map[string]string `json:"failed"`
+}
+
+// Message is a message delivered to a subscriber.
+type Message struct {
+	Seq     uint64 `json:"seq"`
+	Kind    string `json:"kind"`
+	Source  string `json:"source"`
+	Content []byte `json:"content"`
+}
+
+// AckReq is sent by subscribers to acknowledge messages, which are otherwise
+// delivered again on the next subscription.
+type AckReq struct {
+	Ack []uint64 `json:"ack"`
+}
+
+type PollResp struct {
+	Messages []Message `json:"messages"`
+}
@@ -2,39 +2,166 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
-)
-
-type HTTPError struct {
-	StatusCode int
-	Status     string
-	Body       string
-}
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
 
-func (h *HTTPError) Error() string {
-	return fmt.Sprintf("http error: %d: %s: %s", h.StatusCode, h.Status, h.Body)
-}
+	"github.com/kennylevinsen/locshare/api"
+)
 
 type Client struct {
 	Address string
-	token   string
+
+	// TLSConfig is used for https addresses, such as to trust a private CA
+	// or to present a client certificate. If nil, the defaults of net/http
+	// are used. It is ignored for requests if HTTPClient is set, but still
+	// used by subscriptions.
+	TLSConfig *tls.Config
+
+	// HTTPClient sends the requests, such as to use a custom transport. If
+	// nil, a client using TLSConfig is used.
+	HTTPClient *http.Client
+
+	// Retry controls how requests that are safe to repeat are retried.
+	Retry RetryPolicy
+
+	// lock protects the fields below, as subscriptions use and refresh the
+	// session in the background.
+	lock         sync.Mutex
+	token        string
+	refreshToken string
+	httpClient   *http.Client
+
+	// refreshLock serializes refreshes, as using a refresh token twice
+	// revokes the session.
+	refreshLock sync.Mutex
 }
 
 func New(addr string) *Client {
 	return &Client{
 		Address: addr,
+		Retry:   DefaultRetryPolicy,
 	}
 }
 
-func (c *Client) do(req *http.Request) ([]byte, error) {
-	if c.token != "" {
-		req.Header.Set("Cookie", "token="+c.token)
+func (c *Client) tokens() (string, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.token, c.refreshToken
+}
+
+func (c *Client) setTokens(token, refreshToken string) {
+	c.lock.Lock()
+	c.token = token
+	c.refreshToken = refreshToken
+	c.lock.Unlock()
+}
+
+func (c *Client) authorize(hdr http.Header) {
+	if token, _ := c.tokens(); token != "" {
+		hdr.Set("Authorization", api.AuthorizationScheme+" "+token)
+	}
+}
+
+// request describes a call to the server. The http.Request is built anew for
+// every attempt, as its body cannot be reread.
+type request struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+
+	// retry marks the request as safe to repeat. Requests with side effects
+	// beyond their first success, such as publishing or consuming a
+	// one-time key, must not be retried.
+	retry bool
+
+	// gone lists error codes that, when a retry fails with them, mean that
+	// an earlier attempt took effect, such as the session being unknown
+	// after a logout.
+	gone []api.ErrorCode
+}
+
+// alreadyDone reports whether a retry of r failing with err means that an
+// earlier attempt took effect, whose response was lost. It must only be
+// asked if an earlier attempt may have reached the server. A delete finding
+// nothing to delete always does.
+func (r request) alreadyDone(err error) bool {
+	var h *HTTPError
+	if !errors.As(err, &h) {
+		return false
 	}
-	resp, err := http.DefaultClient.Do(req)
+
+	if r.method == "DELETE" && h.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, code := range r.gone {
+		if h.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) do(ctx context.Context, r request) ([]byte, error) {
+	attempts := 1
+	if r.retry && c.Retry.Attempts > 1 {
+		attempts = c.Retry.Attempts
+	}
+
+	var err error
+	var delivered bool
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.Retry.backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+
+		var b []byte
+		b, err = c.send(ctx, r)
+		if err != nil && delivered && r.alreadyDone(err) {
+			return nil, nil
+		}
+		if err == nil || !retryable(ctx, err) {
+			return b, err
+		}
+		delivered = delivered || mayHaveArrived(err)
+	}
+
+	return nil, err
+}
+
+func (c *Client) send(ctx context.Context, r request) ([]byte, error) {
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+
+	req, err := http.NewRequest(r.method, c.Address+r.path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	for k, vs := range r.header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	c.authorize(req.Header)
+
+	resp, err := c.client().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -47,249 +174,450 @@ func (c *Client) do(req *http.Request) ([]byte, error) {
 	}
 
 	if resp.StatusCode != 200 {
-		return nil, &HTTPError{resp.StatusCode, resp.Status, string(b)}
+		return nil, newHTTPError(resp, b)
 	}
 
 	return b, nil
 }
 
-func (c *Client) get(urlPath string) ([]byte, error) {
-	req, err := http.NewRequest("GET", c.Address+urlPath, nil)
-	if err != nil {
-		return nil, err
+func (c *Client) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
 	}
-	return c.do(req)
-}
-
-func (c *Client) getJSON(urlPath string, resp interface{}) error {
-	b, err := c.get(urlPath)
-	if err != nil {
-		return err
+	if c.TLSConfig == nil {
+		return http.DefaultClient
 	}
-	if resp == nil {
-		return nil
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: c.TLSConfig,
+			},
+		}
 	}
-	return json.Unmarshal(b, resp)
+	return c.httpClient
 }
 
-func (c *Client) post(urlPath string, body []byte) ([]byte, error) {
-	var req *http.Request
-	var err error
-	if body != nil {
-		req, err = http.NewRequest("POST", c.Address+urlPath, bytes.NewReader(body))
+// LoadTLSConfig returns a TLS configuration trusting the CA certificates in
+// caFile, and presenting the client certificate in certFile and keyFile.
+// Either may be left empty.
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
 		if err != nil {
 			return nil, err
 		}
-		req.Header.Set("Content-Type", "application/json")
-	} else {
-		req, err = http.NewRequest("POST", c.Address+urlPath, nil)
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
 			return nil, err
 		}
+		cfg.Certificates = []tls.Certificate{cert}
 	}
-	return c.do(req)
+
+	return cfg, nil
 }
 
-func (c *Client) postJSON(urlPath string, body, resp interface{}) error {
-	var b []byte
-	var err error
+// doJSON sends body encoded as JSON if not nil, and decodes the response into
+// resp if not nil.
+func (c *Client) doJSON(ctx context.Context, r request, body, resp interface{}) error {
 	if body != nil {
-		if b, err = json.Marshal(body); err != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
 			return err
 		}
+		r.body = b
+		r.header = http.Header{"Content-Type": {"application/json"}}
 	}
 
-	b, err = c.post(urlPath, b)
+	b, err := c.do(ctx, r)
 	if err != nil {
 		return err
 	}
 	if resp == nil {
 		return nil
 	}
-
 	return json.Unmarshal(b, resp)
 }
 
-func (c *Client) put(urlPath string, body []byte) ([]byte, error) {
-	var req *http.Request
-	var err error
-	if body != nil {
-		req, err = http.NewRequest("PUT", c.Address+urlPath, bytes.NewReader(body))
-		if err != nil {
-			return nil, err
-		}
-		req.Header.Set("Content-Type", "application/json")
-	} else {
-		req, err = http.NewRequest("PUT", c.Address+urlPath, nil)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return c.do(req)
+func (c *Client) get(ctx context.Context, urlPath string) ([]byte, error) {
+	return c.do(ctx, request{method: "GET", path: urlPath, retry: true})
 }
 
-func (c *Client) putJSON(urlPath string, body, resp interface{}) error {
-	var b []byte
-	var err error
-	if body != nil {
-		if b, err = json.Marshal(body); err != nil {
-			return err
-		}
-	}
+func (c *Client) getJSON(ctx context.Context, urlPath string, resp interface{}) error {
+	return c.doJSON(ctx, request{method: "GET", path: urlPath, retry: true}, nil, resp)
+}
 
-	b, err = c.put(urlPath, b)
-	if err != nil {
-		return err
-	}
+func (c *Client) post(ctx context.Context, urlPath string, body []byte) ([]byte, error) {
+	return c.do(ctx, request{method: "POST", path: urlPath, body: body})
+}
 
-	if resp == nil {
-		return nil
-	}
+func (c *Client) postJSON(ctx context.Context, urlPath string, body, resp interface{}) error {
+	return c.doJSON(ctx, request{method: "POST", path: urlPath}, body, resp)
+}
 
-	return json.Unmarshal(b, resp)
+func (c *Client) put(ctx context.Context, urlPath string, body []byte, gone ...api.ErrorCode) ([]byte, error) {
+	return c.do(ctx, request{method: "PUT", path: urlPath, body: body, retry: true, gone: gone})
 }
 
-func (c *Client) delete(urlPath string) ([]byte, error) {
-	req, err := http.NewRequest("DELETE", c.Address+urlPath, nil)
-	if err != nil {
-		return nil, err
+func (c *Client) delete(ctx context.Context, urlPath string, gone ...api.ErrorCode) ([]byte, error) {
+	return c.do(ctx, request{method: "DELETE", path: urlPath, retry: true, gone: gone})
+}
+
+// Login logs in with a session holding the given capabilities.
+func (c *Client) Login(ctx context.Context, username, password string, capabilities []string) error {
+	req := api.AuthReq{
+		Username:     username,
+		Password:     password,
+		Capabilities: capabilities,
 	}
-	return c.do(req)
+	return c.login(ctx, api.AuthRoute, &req)
 }
 
-func (c *Client) deleteJSON(urlPath string, resp interface{}) error {
-	b, err := c.delete(urlPath)
-	if err != nil {
+// LoginRefreshable logs in like Login, but with a short-lived session that
+// Refresh renews.
+func (c *Client) LoginRefreshable(ctx context.Context, username, password string, capabilities []string) error {
+	req := api.AuthReq{
+		Username:     username,
+		Password:     password,
+		Capabilities: capabilities,
+		Refresh:      true,
+	}
+	return c.login(ctx, api.AuthRoute, &req)
+}
+
+// LoginCert logs in as the user the client certificate of TLSConfig maps to.
+func (c *Client) LoginCert(ctx context.Context, capabilities []string) error {
+	req := api.AuthReq{Capabilities: capabilities}
+	return c.login(ctx, api.AuthRoute+api.AuthCert, &req)
+}
+
+func (c *Client) login(ctx context.Context, urlPath string, req *api.AuthReq) error {
+	var resp api.AuthResp
+	if err := c.postJSON(ctx, urlPath, req, &resp); err != nil {
 		return err
 	}
-	if resp == nil {
-		return nil
+
+	if resp.Token == "" {
+		return errors.New("token length 0")
 	}
-	return json.Unmarshal(b, resp)
+
+	c.setTokens(resp.Token, resp.RefreshToken)
+	return nil
 }
 
-type loginReq struct {
-	Username     string   `json:"username"`
-	Password     string   `json:"password"`
-	Capabilities []string `json:"capabilities"`
+// Refresh exchanges the refresh token of a LoginRefreshable login for a new
+// session and refresh token.
+func (c *Client) Refresh(ctx context.Context) error {
+	token, _ := c.tokens()
+	return c.refresh(ctx, token)
 }
 
-func (c *Client) Login(username, password string, capabilities []string) error {
-	req := loginReq{username, password, capabilities}
-	b, err := json.Marshal(&req)
-	if err != nil {
-		return err
+// refresh refreshes the session, unless it has already been refreshed since
+// token was in use.
+func (c *Client) refresh(ctx context.Context, token string) error {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	current, refreshToken := c.tokens()
+	if current != token {
+		return nil
 	}
-	b, err = c.post("/auth", b)
-	if err != nil {
+	if refreshToken == "" {
+		return errors.New("no refresh token")
+	}
+
+	req := api.RefreshReq{RefreshToken: refreshToken}
+	var resp api.AuthResp
+	if err := c.postJSON(ctx, api.AuthRoute+api.AuthRefresh, &req, &resp); err != nil {
 		return err
 	}
 
-	if len(b) == 0 {
-		return errors.New("token length 0")
+	c.setTokens(resp.Token, resp.RefreshToken)
+	return nil
+}
+
+// Logout ends the current session.
+func (c *Client) Logout(ctx context.Context) error {
+	_, err := c.delete(ctx, api.AuthRoute, api.CodeNoSession)
+	if err != nil {
+		return err
 	}
 
-	c.token = string(b)
+	c.setTokens("", "")
 	return nil
 }
 
-type newUserReq struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+func (c *Client) Sessions(ctx context.Context, username string) ([]api.Session, error) {
+	var r api.SessionsResp
+	err := c.getJSON(ctx, api.UserPath(username, api.UserSessions), &r)
+	return r.Sessions, err
+}
+
+func (c *Client) RevokeSession(ctx context.Context, username, id string) error {
+	_, err := c.delete(ctx, api.UserPath(username, api.UserSessions, api.Param(id)))
+	return err
 }
 
-func (c *Client) NewUser(username, password string) error {
-	req := newUserReq{username, password}
-	return c.putJSON("/user", &req, nil)
+func (c *Client) NewUser(ctx context.Context, username, password string) error {
+	req := api.NewUserReq{Username: username, Password: password}
+	return c.postJSON(ctx, api.UserRoute, &req, nil)
 }
 
-func (c *Client) DeleteUser(username, password string) error {
-	_, err := c.delete("/user/" + username + "/name")
+// DeleteUser deletes a user. It requires a session with the destroyer
+// capability.
+func (c *Client) DeleteUser(ctx context.Context, username string) error {
+	// Deleting the user ends its sessions, including this one.
+	_, err := c.delete(ctx, api.UserPath(username), api.CodeNoSession)
 	return err
 }
 
-func (c *Client) Name(username string) (string, error) {
-	b, err := c.get("/user/" + username + "/name")
-	return string(b), err
+func (c *Client) SetPassword(ctx context.Context, username, oldpassword, newpassword string) error {
+	req := api.PasswordReq{OldPassword: oldpassword, NewPassword: newpassword}
+	return c.postJSON(ctx, api.UserPath(username, api.UserPassword), &req, nil)
 }
 
-func (c *Client) SetName(username, name string) error {
-	_, err := c.put("/user/"+username+"/name", []byte(name))
+func (c *Client) Identity(ctx context.Context, username string) ([]byte, error) {
+	return c.get(ctx, api.UserPath(username, api.UserIdentity))
+}
+
+func (c *Client) SetIdentity(ctx context.Context, username string, identity []byte) error {
+	_, err := c.put(ctx, api.UserPath(username, api.UserIdentity), identity)
 	return err
 }
 
-type postPasswordReq struct {
-	OldPassword string `json:"oldPassword"`
-	NewPassword string `json:"newPassword"`
+// TemporaryKey fetches the signed prekey of the user and its signature. The
+// server has verified the signature against the identity key it holds, but
+// callers should verify it with prekey.Verify against the identity key they
+// trust for the user.
+func (c *Client) TemporaryKey(ctx context.Context, username string) (uint64, []byte, []byte, error) {
+	var r api.KeyResp
+	err := c.getJSON(ctx, api.UserPath(username, api.UserTemporaryKey), &r)
+	return r.KeyID, r.Key, r.Signature, err
 }
 
-func (c *Client) SetPassword(username, oldpassword, newpassword string) error {
-	req := postPasswordReq{oldpassword, newpassword}
-	return c.postJSON("/user/"+username+"/password", &req, nil)
+// SetTemporaryKey uploads a signed prekey, which is rejected unless signature
+// is its signature by the identity key of the user.
+func (c *Client) SetTemporaryKey(ctx context.Context, username string, keyID uint64, key, signature []byte) error {
+	req := api.TemporaryKeyReq{Key: key, Signature: signature}
+	return c.doJSON(ctx, request{method: "PUT", path: api.UserPath(username, api.UserTemporaryKey, api.ParamUint(keyID)), retry: true}, &req, nil)
 }
 
-func (c *Client) Identity(username string) ([]byte, error) {
-	return c.get("/user/" + username + "/identity")
+// OneTimeKey fetches a one-time key of the user, which is removed from the
+// server as it is handed out.
+func (c *Client) OneTimeKey(ctx context.Context, username string) (uint64, []byte, error) {
+	// Not retried, as a lost response would consume a second key.
+	var r api.KeyResp
+	err := c.doJSON(ctx, request{method: "GET", path: api.UserPath(username, api.UserOneTimeKey)}, nil, &r)
+	return r.KeyID, r.Key, err
 }
 
-func (c *Client) SetIdentity(username string, identity []byte) error {
-	_, err := c.put("/user/"+username+"/identity", identity)
+func (c *Client) SetOneTimeKey(ctx context.Context, username string, keyID uint64, key []byte) error {
+	_, err := c.put(ctx, api.UserPath(username, api.UserOneTimeKey, api.ParamUint(keyID)), key, api.CodeKeyIDInUse)
 	return err
 }
 
-type getSignedKeyResp struct {
-	KeyID uint64 `json:"keyID"`
-	Key   []byte `json:"key"`
+func (c *Client) DeleteOneTimeKey(ctx context.Context, username string, keyID uint64) error {
+	_, err := c.delete(ctx, api.UserPath(username, api.UserOneTimeKey, api.ParamUint(keyID)))
+	return err
 }
 
-func (c *Client) SignedKey(username string) (uint64, []byte, error) {
-	var r getSignedKeyResp
-	err := c.getJSON("/user/"+username+"/signedKey", &r)
-	return r.KeyID, r.Key, err
+func (c *Client) OneTimeKeys(ctx context.Context, username string) ([]uint64, error) {
+	var r api.OneTimeKeysResp
+	err := c.getJSON(ctx, api.UserPath(username, api.UserOneTimeKeys), &r)
+	return r.Keys, err
 }
 
-func (c *Client) SetSignedKey(username string, keyID uint64, key []byte) error {
-	_, err := c.put(fmt.Sprintf("/user/%s/signedKey/%d", username, keyID), key)
+// SendMessage sends a message, which the server keeps queued until it is
+// acknowledged or a server set time-to-live passes. The number of messages
+// dropped this way is reported by UserStats.
+func (c *Client) SendMessage(ctx context.Context, username string, content []byte) error {
+	// Not retried, as a lost response would deliver the message twice.
+	_, err := c.do(ctx, request{method: "PUT", path: api.UserPath(username, api.UserMessage), body: content})
 	return err
 }
 
-func (c *Client) SetKey(username string, keyID uint64, key []byte) error {
-	_, err := c.put(fmt.Sprintf("/user/%s/key/%d", username, keyID), key)
+// SendMessageTTL sends a message that is dropped if not delivered within ttl.
+// The server may cap ttl.
+func (c *Client) SendMessageTTL(ctx context.Context, username string, content []byte, ttl time.Duration) error {
+	_, err := c.do(ctx, request{
+		method: "PUT",
+		path:   api.UserPath(username, api.UserMessage),
+		header: http.Header{api.TTLHeader: {strconv.FormatInt(int64(ttl/time.Second), 10)}},
+		body:   content,
+	})
 	return err
 }
 
-func (c *Client) DeleteKey(username string, keyID uint64) error {
-	_, err := c.delete(fmt.Sprintf("/user/%s/key/%d", username, keyID))
+// Sharing returns the users sharing their location with username, and those
+// asking to.
+func (c *Client) Sharing(ctx context.Context, username string) (api.SharingResp, error) {
+	var r api.SharingResp
+	err := c.getJSON(ctx, api.UserPath(username, api.UserSharing), &r)
+	return r, err
+}
+
+// RequestSharing asks username to accept locations from the user of the
+// session.
+func (c *Client) RequestSharing(ctx context.Context, username string) error {
+	_, err := c.post(ctx, api.UserPath(username, api.UserSharing), nil)
 	return err
 }
 
-type getKeyResp struct {
-	KeyID uint64 `json:"keyID"`
-	Key   []byte `json:"key"`
+func (c *Client) AcceptSharing(ctx context.Context, username, source string) error {
+	_, err := c.put(ctx, api.UserPath(username, api.UserSharing, api.Param(source)), nil)
+	return err
 }
 
-func (c *Client) Key(username string) (uint64, []byte, error) {
-	var r getKeyResp
-	err := c.getJSON("/user/"+username+"/key", &r)
-	return r.KeyID, r.Key, err
+// RemoveSharing rejects or revokes sharing from source to username. Either
+// of them may do so.
+func (c *Client) RemoveSharing(ctx context.Context, username, source string) error {
+	_, err := c.delete(ctx, api.UserPath(username, api.UserSharing, api.Param(source)))
+	return err
 }
 
-type getKeysResp struct {
-	Keys []uint64 `json:"keys"`
+func (c *Client) Contacts(ctx context.Context, username string) ([]api.Contact, error) {
+	var r api.ContactsResp
+	err := c.getJSON(ctx, api.UserPath(username, api.UserContacts), &r)
+	return r.Contacts, err
 }
 
-func (c *Client) Keys(username string) ([]uint64, error) {
-	var r getKeysResp
-	err := c.getJSON("/user/"+username+"/keys", &r)
-	return r.Keys, err
+func (c *Client) RequestContact(ctx context.Context, username, other string) error {
+	_, err := c.post(ctx, api.UserPath(username, api.UserContacts, api.Param(other)), nil)
+	return err
+}
+
+func (c *Client) AcceptContact(ctx context.Context, username, other string) error {
+	_, err := c.put(ctx, api.UserPath(username, api.UserContacts, api.Param(other)), nil, api.CodeNoSuchRequest)
+	return err
+}
+
+func (c *Client) RemoveContact(ctx context.Context, username, other string) error {
+	_, err := c.delete(ctx, api.UserPath(username, api.UserContacts, api.Param(other)))
+	return err
+}
+
+func (c *Client) Blocked(ctx context.Context, username string) ([]string, error) {
+	var r api.BlocksResp
+	err := c.getJSON(ctx, api.UserPath(username, api.UserBlocks), &r)
+	return r.Blocked, err
+}
+
+func (c *Client) Block(ctx context.Context, username, other string) error {
+	_, err := c.put(ctx, api.UserPath(username, api.UserBlocks, api.Param(other)), nil)
+	return err
+}
+
+func (c *Client) Unblock(ctx context.Context, username, other string) error {
+	_, err := c.delete(ctx, api.UserPath(username, api.UserBlocks, api.Param(other)))
+	return err
+}
+
+func (c *Client) Devices(ctx context.Context, username string) ([]api.Device, error) {
+	var r api.DevicesResp
+	err := c.getJSON(ctx, api.UserPath(username, api.UserDevices), &r)
+	return r.Devices, err
+}
+
+// RegisterDevice registers a device, and binds the current session to it.
+func (c *Client) RegisterDevice(ctx context.Context, username, device string) error {
+	_, err := c.put(ctx, api.UserPath(username, api.UserDevices, api.Param(device)), nil)
+	return err
+}
+
+func (c *Client) RemoveDevice(ctx context.Context, username, device string) error {
+	_, err := c.delete(ctx, api.UserPath(username, api.UserDevices, api.Param(device)))
+	return err
+}
+
+func (c *Client) UserStats(ctx context.Context, username string) (api.Stats, error) {
+	var r api.Stats
+	err := c.getJSON(ctx, api.UserPath(username, api.UserStats), &r)
+	return r, err
+}
+
+// Stats returns message counts of the whole server. It requires a session
+// with the admin capability.
+func (c *Client) Stats(ctx context.Context) (api.ServerStats, error) {
+	var r api.ServerStats
+	err := c.getJSON(ctx, api.StatsRoute, &r)
+	return r, err
+}
+
+func (c *Client) Groups(ctx context.Context) ([]api.Group, error) {
+	var r api.GroupsResp
+	err := c.getJSON(ctx, api.GroupRoute, &r)
+	return r.Groups, err
+}
+
+func (c *Client) NewGroup(ctx context.Context, name string) (api.Group, error) {
+	req := api.NewGroupReq{Name: name}
+	var r api.Group
+	err := c.postJSON(ctx, api.GroupRoute, &req, &r)
+	return r, err
+}
+
+func (c *Client) Group(ctx context.Context, id string) (api.Group, error) {
+	var r api.Group
+	err := c.getJSON(ctx, api.GroupPath(id), &r)
+	return r, err
+}
+
+func (c *Client) DeleteGroup(ctx context.Context, id string) error {
+	_, err := c.delete(ctx, api.GroupPath(id))
+	return err
 }
 
-func (c *Client) DeleteMessages(username string) error {
-	_, err := c.delete("/user/" + username + "/messages")
+// JoinGroup invites member to the group if done by the owner, or accepts an
+// invitation if done by the member.
+func (c *Client) JoinGroup(ctx context.Context, id, member string) error {
+	// A retried join finds the invitation used, and a retried invitation
+	// finds the member joined.
+	_, err := c.put(ctx, api.GroupPath(id, api.GroupMember, api.Param(member)), nil, api.CodeNotInvited, api.CodeAlreadyMember)
 	return err
 }
 
-func (c *Client) SendMessage(username string, content []byte) error {
-	_, err := c.put("/user/"+username+"/message", content)
+// LeaveGroup leaves the group or declines an invitation if done by the member,
+// or removes the member if done by the owner.
+func (c *Client) LeaveGroup(ctx context.Context, id, member string) error {
+	_, err := c.delete(ctx, api.GroupPath(id, api.GroupMember, api.Param(member)), api.CodeNotMember)
 	return err
 }
+
+// SendGroupMessage sends a separately encrypted copy of a message to each
+// recipient in the group.
+func (c *Client) SendGroupMessage(ctx context.Context, id string, req api.GroupMessageReq) (api.GroupMessageResp, error) {
+	var r api.GroupMessageResp
+	err := c.doJSON(ctx, request{method: "PUT", path: api.GroupPath(id, api.GroupMessage)}, &req, &r)
+	return r, err
+}
+
+// Poll waits up to timeout for messages after since, acknowledging
+// everything up to and including since.
+func (c *Client) Poll(ctx context.Context, since uint64, timeout time.Duration) ([]api.Message, error) {
+	q := url.Values{}
+	q.Set("since", strconv.FormatUint(since, 10))
+	q.Set("timeout", strconv.FormatInt(int64(timeout/time.Second), 10))
+
+	var r api.PollResp
+	err := c.getJSON(ctx, api.PollRoute+api.SubscribeRoute+"?"+q.Encode(), &r)
+	return r.Messages, err
+}
+
+// Ack acknowledges messages received by the device of the session.
+func (c *Client) Ack(ctx context.Context, seqs ...uint64) error {
+	req := api.AckReq{Ack: seqs}
+	return c.postJSON(ctx, api.AckRoute, &req, nil)
+}
@@ -0,0 +1,231 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/locshare/api"
+	"github.com/kennylevinsen/locshare/client"
+	"github.com/kennylevinsen/locshare/prekey"
+	"github.com/kennylevinsen/locshare/server"
+)
+
+var caps = []string{"interactive", "publish"}
+
+// newTestServer starts a server with in-memory backends, and returns clients
+// logged in as alice, with a refreshable session, and bob.
+func newTestServer(t *testing.T) (alice, bob *client.Client) {
+	t.Helper()
+
+	s := server.NewServer(server.Config{})
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		ts.Close()
+		s.Close()
+	})
+
+	ctx := context.Background()
+	alice, bob = client.New(ts.URL), client.New(ts.URL)
+	for _, c := range []struct {
+		c    *client.Client
+		name string
+	}{{alice, "alice"}, {bob, "bob"}} {
+		if err := c.c.NewUser(ctx, c.name, c.name+"-password"); err != nil {
+			t.Fatalf("creating %s: %v", c.name, err)
+		}
+	}
+
+	if err := alice.LoginRefreshable(ctx, "alice", "alice-password", caps); err != nil {
+		t.Fatalf("logging in alice: %v", err)
+	}
+	if err := bob.Login(ctx, "bob", "bob-password", caps); err != nil {
+		t.Fatalf("logging in bob: %v", err)
+	}
+
+	return alice, bob
+}
+
+func TestAuth(t *testing.T) {
+	alice, _ := newTestServer(t)
+	ctx := context.Background()
+
+	if err := alice.Login(ctx, "alice", "wrong", caps); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("login with wrong password: got %v, want ErrPermissionDenied", err)
+	}
+
+	if err := alice.Refresh(ctx); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	sess, err := alice.Sessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("listing sessions: %v", err)
+	}
+	if len(sess) == 0 {
+		t.Fatal("got no sessions after refresh")
+	}
+
+	if err := alice.Logout(ctx); err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+	if _, err := alice.Sessions(ctx, "alice"); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("listing sessions after logout: got %v, want ErrPermissionDenied", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	alice, bob := newTestServer(t)
+	ctx := context.Background()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.SetIdentity(ctx, "alice", pub); err != nil {
+		t.Fatalf("uploading identity: %v", err)
+	}
+
+	identity, err := bob.Identity(ctx, "alice")
+	if err != nil {
+		t.Fatalf("fetching identity: %v", err)
+	}
+	if !bytes.Equal(identity, pub) {
+		t.Fatalf("got identity %x, want %x", identity, []byte(pub))
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	sig := ed25519.Sign(priv, key)
+
+	bad := append([]byte(nil), sig...)
+	bad[0] ^= 1
+	if err := alice.SetTemporaryKey(ctx, "alice", 1, key, bad); !errors.Is(err, client.ErrInvalidRequest) {
+		t.Fatalf("uploading prekey with bad signature: got %v, want ErrInvalidRequest", err)
+	}
+
+	if err := alice.SetTemporaryKey(ctx, "alice", 1, key, sig); err != nil {
+		t.Fatalf("uploading prekey: %v", err)
+	}
+
+	id, gotKey, gotSig, err := bob.TemporaryKey(ctx, "alice")
+	if err != nil {
+		t.Fatalf("fetching prekey: %v", err)
+	}
+	if id != 1 || !bytes.Equal(gotKey, key) {
+		t.Fatalf("got prekey %d %x, want 1 %x", id, gotKey, key)
+	}
+	if err := prekey.Verify(identity, gotKey, gotSig); err != nil {
+		t.Fatalf("verifying fetched prekey: %v", err)
+	}
+
+	otk := []byte("one-time key")
+	if err := alice.SetOneTimeKey(ctx, "alice", 7, otk); err != nil {
+		t.Fatalf("uploading one-time key: %v", err)
+	}
+
+	id, gotKey, err = bob.OneTimeKey(ctx, "alice")
+	if err != nil {
+		t.Fatalf("fetching one-time key: %v", err)
+	}
+	if id != 7 || !bytes.Equal(gotKey, otk) {
+		t.Fatalf("got one-time key %d %q, want 7 %q", id, gotKey, otk)
+	}
+
+	if _, _, err := bob.OneTimeKey(ctx, "alice"); !errors.Is(err, client.ErrNoPrekeys) {
+		t.Fatalf("fetching used one-time key: got %v, want ErrNoPrekeys", err)
+	}
+}
+
+// receive waits for the next message of sub.
+func receive(t *testing.T, sub *client.Subscription) api.Message {
+	t.Helper()
+
+	select {
+	case m, ok := <-sub.Messages:
+		if !ok {
+			t.Fatalf("subscription ended: %v", sub.Err())
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return api.Message{}
+}
+
+func TestMessages(t *testing.T) {
+	alice, bob := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := bob.SendMessage(ctx, "alice", []byte("early")); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("publishing without sharing: got %v, want ErrPermissionDenied", err)
+	}
+
+	if err := bob.RequestSharing(ctx, "alice"); err != nil {
+		t.Fatalf("requesting sharing: %v", err)
+	}
+	if err := alice.AcceptSharing(ctx, "alice", "bob"); err != nil {
+		t.Fatalf("accepting sharing: %v", err)
+	}
+
+	sub, err := alice.Subscribe(ctx, 0)
+	if err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+
+	if err := bob.SendMessage(ctx, "alice", []byte("first")); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+
+	m := receive(t, sub)
+	if m.Source != "bob" || m.Kind != "message" || string(m.Content) != "first" {
+		t.Fatalf("got %+v, want message \"first\" from bob", m)
+	}
+
+	// Messages published while not subscribed stay queued until acked.
+	cancel()
+	for range sub.Messages {
+	}
+
+	ctx = context.Background()
+	if err := bob.SendMessage(ctx, "alice", []byte("second")); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+
+	msgs, err := alice.Poll(ctx, 0, time.Second)
+	if err != nil {
+		t.Fatalf("polling: %v", err)
+	}
+
+	// Both messages are still queued, as neither has been acked.
+	var got []string
+	var seqs []uint64
+	for i, m := range msgs {
+		if i > 0 && m.Seq <= msgs[i-1].Seq {
+			t.Fatalf("message %d polled after %d", m.Seq, msgs[i-1].Seq)
+		}
+		got = append(got, string(m.Content))
+		seqs = append(seqs, m.Seq)
+	}
+	if len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Fatalf("polled %q, want [first second]", got)
+	}
+
+	if err := alice.Ack(ctx, seqs...); err != nil {
+		t.Fatalf("acking: %v", err)
+	}
+	msgs, err = alice.Poll(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("polling: %v", err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("got %d messages after acking, want none", len(msgs))
+	}
+}
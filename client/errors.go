@@ -0,0 +1,87 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/kennylevinsen/locshare/api"
+)
+
+// Errors reported by the server. They are matched with errors.Is against the
+// *HTTPError returned by requests, which holds the details.
+var (
+	ErrInvalidRequest   = errors.New("invalid request")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrNotFound         = errors.New("not found")
+	ErrNoSuchUser       = errors.New("no such user")
+	ErrNoPrekeys        = errors.New("no prekeys available")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrTooLarge         = errors.New("request too large")
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+	ErrServer           = errors.New("server error")
+)
+
+// HTTPError is a request rejected by the server.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+
+	// Code identifies the error, if the server sent one.
+	Code api.ErrorCode
+
+	// Message is the reason given by the server, or the raw body if it did
+	// not send an api.ErrorResp.
+	Message string
+}
+
+func newHTTPError(resp *http.Response, body []byte) *HTTPError {
+	h := &HTTPError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Message:    string(body),
+	}
+
+	var e api.ErrorResp
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		h.Code = e.Code
+		h.Message = e.Error
+	}
+	return h
+}
+
+func (h *HTTPError) Error() string {
+	if h.Code != "" {
+		return fmt.Sprintf("http error: %s: %s: %s", h.Status, h.Code, h.Message)
+	}
+	return fmt.Sprintf("http error: %s: %s", h.Status, h.Message)
+}
+
+// Is reports whether the error is of the kind of target, one of the errors of
+// this package. ErrNoSuchUser and ErrNoPrekeys errors are also ErrNotFound
+// errors, and ErrQuotaExceeded errors are also ErrRateLimited errors.
+func (h *HTTPError) Is(target error) bool {
+	switch target {
+	case ErrInvalidRequest:
+		return h.StatusCode == http.StatusBadRequest
+	case ErrPermissionDenied:
+		return h.StatusCode == http.StatusUnauthorized || h.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return h.StatusCode == http.StatusNotFound
+	case ErrNoSuchUser:
+		return h.Code == api.CodeNoSuchUser
+	case ErrNoPrekeys:
+		return h.Code == api.CodeNoPrekeys
+	case ErrRateLimited:
+		return h.StatusCode == http.StatusTooManyRequests
+	case ErrTooLarge:
+		return h.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrQuotaExceeded:
+		return h.Code == api.CodeQuotaExceeded
+	case ErrServer:
+		return h.StatusCode >= 500
+	default:
+		return false
+	}
+}
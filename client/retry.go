@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how requests are retried. The delay before a retry
+// doubles with every attempt from MinBackoff up to MaxBackoff, and is
+// randomized so that clients failing at the same time do not retry at the
+// same time.
+type RetryPolicy struct {
+	// Attempts is the number of attempts made, including the first. Zero or
+	// one disables retries.
+	Attempts   int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy of clients created with New.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	MinBackoff: 250 * time.Millisecond,
+	MaxBackoff: 5 * time.Second,
+}
+
+// backoff returns the delay before the given retry, counting from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return jitter(d)
+}
+
+// jitter returns a random duration between d/2 and 3d/2.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// retryable reports whether a failed request may succeed if repeated. Failures
+// to reach the server and temporary server conditions are retried, but not
+// rejections of the request itself.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var h *HTTPError
+	if !errors.As(err, &h) {
+		return true
+	}
+
+	switch h.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// mayHaveArrived reports whether a request failing with a retryable error may
+// still have been carried out by the server. Only failures to connect and
+// rate limiting guarantee that it was not.
+func mayHaveArrived(err error) bool {
+	var h *HTTPError
+	if errors.As(err, &h) {
+		return h.StatusCode != http.StatusTooManyRequests
+	}
+
+	var op *net.OpError
+	return !errors.As(err, &op) || op.Op != "dial"
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
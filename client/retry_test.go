@@ -0,0 +1,121 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/locshare/client"
+	"github.com/kennylevinsen/locshare/server"
+)
+
+// lossyHandler fails the first PUT and DELETE of each session, path and
+// method. If serve is set, the request is carried out and only the response
+// is lost, otherwise the request is rejected without reaching h.
+type lossyHandler struct {
+	h      http.Handler
+	serve  bool
+	status int
+
+	lock sync.Mutex
+	seen map[string]bool
+}
+
+func (l *lossyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Authorization") + " " + r.Method + " " + r.URL.Path
+	l.lock.Lock()
+	first := (r.Method == "PUT" || r.Method == "DELETE") && !l.seen[key]
+	l.seen[key] = true
+	l.lock.Unlock()
+
+	if !first {
+		l.h.ServeHTTP(w, r)
+		return
+	}
+
+	if l.serve {
+		l.h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	w.WriteHeader(l.status)
+}
+
+// newLossyClients returns clients logged in as alice and bob, whose first
+// attempts at each PUT and DELETE fail as l decides.
+func newLossyClients(t *testing.T, l *lossyHandler) (alice, bob *client.Client) {
+	t.Helper()
+
+	s := server.NewServer(server.Config{})
+	l.h = s
+	l.seen = make(map[string]bool)
+	ts := httptest.NewServer(l)
+	t.Cleanup(func() {
+		ts.Close()
+		s.Close()
+	})
+
+	ctx := context.Background()
+	alice, bob = client.New(ts.URL), client.New(ts.URL)
+	for _, c := range []struct {
+		c    *client.Client
+		name string
+	}{{alice, "alice"}, {bob, "bob"}} {
+		c.c.Retry.MinBackoff = time.Millisecond
+		if err := c.c.NewUser(ctx, c.name, c.name+"-password"); err != nil {
+			t.Fatalf("creating %s: %v", c.name, err)
+		}
+		if err := c.c.Login(ctx, c.name, c.name+"-password", caps); err != nil {
+			t.Fatalf("logging in %s: %v", c.name, err)
+		}
+	}
+
+	return alice, bob
+}
+
+func TestRetriedRequests(t *testing.T) {
+	alice, bob := newLossyClients(t, &lossyHandler{serve: true, status: http.StatusServiceUnavailable})
+	ctx := context.Background()
+
+	if err := alice.SetOneTimeKey(ctx, "alice", 1, []byte("key")); err != nil {
+		t.Fatalf("uploading one-time key: %v", err)
+	}
+	if err := alice.DeleteOneTimeKey(ctx, "alice", 1); err != nil {
+		t.Fatalf("deleting one-time key: %v", err)
+	}
+
+	if err := bob.RequestContact(ctx, "bob", "alice"); err != nil {
+		t.Fatalf("requesting contact: %v", err)
+	}
+	if err := alice.AcceptContact(ctx, "alice", "bob"); err != nil {
+		t.Fatalf("accepting contact: %v", err)
+	}
+
+	g, err := alice.NewGroup(ctx, "group")
+	if err != nil {
+		t.Fatalf("creating group: %v", err)
+	}
+	if err := alice.JoinGroup(ctx, g.ID, "bob"); err != nil {
+		t.Fatalf("inviting: %v", err)
+	}
+	if err := bob.JoinGroup(ctx, g.ID, "bob"); err != nil {
+		t.Fatalf("joining: %v", err)
+	}
+
+	if err := alice.Logout(ctx); err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+}
+
+func TestRetriedUndeliveredDelete(t *testing.T) {
+	alice, _ := newLossyClients(t, &lossyHandler{status: http.StatusTooManyRequests})
+	ctx := context.Background()
+
+	// The first attempt was rejected before reaching the server, so the key
+	// never existed rather than having been deleted by it.
+	if err := alice.DeleteOneTimeKey(ctx, "alice", 1); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("deleting missing one-time key: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/locshare/api"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reconnection backoff of subscriptions. The delay doubles with every failed
+// attempt, and is reset once connected.
+const (
+	SubscribeMinBackoff = 500 * time.Millisecond
+	SubscribeMaxBackoff = 30 * time.Second
+
+	// SubscribeHandshakeTimeout bounds the websocket handshake.
+	SubscribeHandshakeTimeout = 30 * time.Second
+)
+
+// Subscription receives the messages of the user of a client over a
+// websocket, reconnecting when the connection is lost.
+type Subscription struct {
+	// Messages delivers the messages. It is closed when the subscription
+	// ends.
+	Messages <-chan api.Message
+
+	c        *Client
+	messages chan api.Message
+
+	// since is the highest sequence number delivered, which reconnections
+	// resume after.
+	since uint64
+
+	errLock sync.Mutex
+	err     error
+}
+
+// Err returns why the subscription ended, once Messages is closed.
+func (s *Subscription) Err() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.err
+}
+
+// Subscribe subscribes to messages after since, or to all unacknowledged
+// messages if since is zero. Messages are acknowledged once received from
+// Messages. The subscription reconnects with backoff when the connection is
+// lost, refreshing the session if it has expired, and ends when ctx is done
+// or the session cannot be renewed.
+func (c *Client) Subscribe(ctx context.Context, since uint64) (*Subscription, error) {
+	conn, err := c.connect(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make(chan api.Message)
+	s := &Subscription{
+		Messages: messages,
+		c:        c,
+		messages: messages,
+		since:    since,
+	}
+	go s.run(ctx, conn)
+	return s, nil
+}
+
+// connect dials the websocket, refreshing the session and retrying once if it
+// is rejected.
+func (c *Client) connect(ctx context.Context, since uint64) (*websocket.Conn, error) {
+	token, _ := c.tokens()
+	conn, err := c.dial(ctx, since)
+	if herr, ok := err.(*HTTPError); ok && herr.StatusCode == http.StatusUnauthorized {
+		if _, refreshToken := c.tokens(); refreshToken == "" {
+			return nil, err
+		}
+		if err := c.refresh(ctx, token); err != nil {
+			return nil, err
+		}
+		conn, err = c.dial(ctx, since)
+	}
+	return conn, err
+}
+
+func (c *Client) dial(ctx context.Context, since uint64) (*websocket.Conn, error) {
+	u, err := url.Parse(c.Address + api.WSRoute + api.SubscribeRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+
+	if since > 0 {
+		q := u.Query()
+		q.Set("since", strconv.FormatUint(since, 10))
+		u.RawQuery = q.Encode()
+	}
+
+	hdr := http.Header{}
+	c.authorize(hdr)
+
+	d := websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: c.TLSConfig,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			var nd net.Dialer
+			return nd.DialContext(ctx, network, addr)
+		},
+		HandshakeTimeout: SubscribeHandshakeTimeout,
+	}
+
+	conn, resp, err := d.Dial(u.String(), hdr)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, newHTTPError(resp, b)
+	}
+	return conn, err
+}
+
+func (s *Subscription) run(ctx context.Context, conn *websocket.Conn) {
+	defer close(s.messages)
+
+	backoff := SubscribeMinBackoff
+	for {
+		s.receive(ctx, conn)
+
+		for {
+			// Jitter keeps clients disconnected at the same time from
+			// reconnecting at the same time.
+			if err := sleep(ctx, jitter(backoff)); err != nil {
+				s.end(err)
+				return
+			}
+
+			var err error
+			conn, err = s.c.connect(ctx, s.since)
+			if err == nil {
+				backoff = SubscribeMinBackoff
+				break
+			}
+			if permanent(err) {
+				s.end(err)
+				return
+			}
+
+			if backoff *= 2; backoff > SubscribeMaxBackoff {
+				backoff = SubscribeMaxBackoff
+			}
+		}
+	}
+}
+
+// receive delivers messages from conn until it fails or ctx is done.
+func (s *Subscription) receive(ctx context.Context, conn *websocket.Conn) {
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		var m api.Message
+		if err := conn.ReadJSON(&m); err != nil {
+			return
+		}
+
+		select {
+		case s.messages <- m:
+		case <-ctx.Done():
+			return
+		}
+
+		// Gaps have no sequence number.
+		if m.Seq == 0 {
+			continue
+		}
+
+		if m.Seq > s.since {
+			s.since = m.Seq
+		}
+		if err := conn.WriteJSON(&api.AckReq{Ack: []uint64{m.Seq}}); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Subscription) end(err error) {
+	s.errLock.Lock()
+	s.err = err
+	s.errLock.Unlock()
+}
+
+// permanent reports whether a failure to connect will not go away by itself.
+func permanent(err error) bool {
+	return errors.Is(err, ErrPermissionDenied) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidRequest)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -10,7 +11,7 @@ import (
 func main() {
 	c := client.New(os.Args[1])
 
-	err := c.NewUser(os.Args[2], os.Args[3])
+	err := c.NewUser(context.Background(), os.Args[2], os.Args[3])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failure: %v\n", err)
 		return
@@ -2,20 +2,40 @@ package main
 
 import (
 	"encoding/base64"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/curve25519"
 
 	"github.com/kennylevinsen/ecies"
 	"github.com/kennylevinsen/locshare"
+	"github.com/kennylevinsen/locshare/proto"
 )
 
+// pingInterval must be shorter than the read timeout of subscribed
+// connections on the server.
+const pingInterval = 4 * time.Minute
+
 func main() {
+	allow := flag.String("allow", "", "comma separated list of users to accept locations from; only the own user if empty")
+	flag.Parse()
+
+	addr, username, password := flag.Arg(0), flag.Arg(2), flag.Arg(3)
+
+	allowed := map[string]bool{username: true}
+	if *allow != "" {
+		allowed = make(map[string]bool)
+		for _, u := range strings.Split(*allow, ",") {
+			allowed[u] = true
+		}
+	}
 
-	privKey, err := base64.StdEncoding.DecodeString(os.Args[2])
+	privKey, err := base64.StdEncoding.DecodeString(flag.Arg(1))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error decoding private key: %v\n", err)
 		return
@@ -35,24 +55,30 @@ func main() {
 	pubstr := base64.StdEncoding.EncodeToString(pub[:])
 	fmt.Fprintf(os.Stderr, "Listening on: %s\n", pubstr)
 
-	c, err := net.Dial("tcp", os.Args[1])
+	c, err := net.Dial("tcp", addr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error dialing service: %v\n", err)
 		return
 	}
 
+	conn := proto.NewConn(c)
+	if err := conn.Hello(); err != nil {
+		fmt.Fprintf(os.Stderr, "error negotiating protocol version: %v\n", err)
+		return
+	}
+
 	req := map[string]string{
 		"m":    "auth",
-		"user": os.Args[3],
-		"pass": os.Args[4],
+		"user": username,
+		"pass": password,
 	}
 
-	if err := locshare.ProtoWrite(req, c); err != nil {
+	if err := conn.Write(req); err != nil {
 		fmt.Fprintf(os.Stderr, "error writing proto: %v\n", err)
 		return
 	}
 
-	msg, err := locshare.ProtoRead(c)
+	msg, err := conn.Read()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error reading proto: %v\n", err)
 		return
@@ -66,17 +92,17 @@ func main() {
 	}
 
 	req = map[string]string{
-		"m": "t",
-		"user": os.Args[3],
-		"t": token,
+		"m":    "t",
+		"user": username,
+		"t":    token,
 	}
 
-	if err := locshare.ProtoWrite(req, c); err != nil {
+	if err := conn.Write(req); err != nil {
 		fmt.Fprintf(os.Stderr, "error writing proto: %v\n", err)
 		return
 	}
 
-	msg, err = locshare.ProtoRead(c)
+	msg, err = conn.Read()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error reading proto: %v\n", err)
 		return
@@ -91,13 +117,26 @@ func main() {
 		"m": "sub",
 	}
 
-	if err := locshare.ProtoWrite(req, c); err != nil {
+	if err := conn.Write(req); err != nil {
 		fmt.Fprintf(os.Stderr, "error writing proto: %v\n", err)
 		return
 	}
 
+	// Pings keep the connection open while there is nothing to ack.
+	var writeLock sync.Mutex
+	go func() {
+		for range time.Tick(pingInterval) {
+			writeLock.Lock()
+			err := conn.Write(map[string]string{"m": "ping"})
+			writeLock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
 	for {
-		msg, err := locshare.ProtoRead(c)
+		msg, err := conn.Read()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error reading proto: %v\n", err)
 			return
@@ -108,17 +147,32 @@ func main() {
 			fmt.Fprintf(os.Stderr, "error: %v\n", msg["error"])
 			return
 		case "p":
-			if msg["o"] != pubstr {
-				fmt.Printf("Got message from unknown sender %s, skipping\n", msg["o"])
+			// Gaps have no sequence number to acknowledge.
+			if msg["s"] != "0" {
+				ack := map[string]string{
+					"m": "ack",
+					"s": msg["s"],
+				}
+
+				writeLock.Lock()
+				err := conn.Write(ack)
+				writeLock.Unlock()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error writing proto: %v\n", err)
+					return
+				}
+			}
+
+			if msg["k"] != "message" {
 				continue
 			}
 
-			blob := []byte(msg["l"])
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error decoding data: %v\n", err)
-				return
+			if !allowed[msg["o"]] {
+				fmt.Printf("Got message from unknown sender %s, skipping\n", msg["o"])
+				continue
 			}
 
+			blob := []byte(msg["l"])
 			res, err := ecies.Decrypt(blob, priv[:])
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error decrypting: %v\n", err)
@@ -131,7 +185,7 @@ func main() {
 				return
 			}
 
-			fmt.Printf("%v: accuracy: %.2f, coordinates: %.5f, %.5f, altitude: %.2f, bearing: %.2f, speed: %.2f\n", time.Unix(int64(loc.Time)/1000, 0), loc.Accuracy, loc.Latitude, loc.Longitude, loc.Altitude, loc.Bearing, loc.Speed)
+			fmt.Printf("%v: %s: accuracy: %.2f, coordinates: %.5f, %.5f, altitude: %.2f, bearing: %.2f, speed: %.2f\n", time.Unix(int64(loc.Time)/1000, 0), msg["o"], loc.Accuracy, loc.Latitude, loc.Longitude, loc.Altitude, loc.Bearing, loc.Speed)
 
 		default:
 			fmt.Fprintf(os.Stderr, "no method\n")
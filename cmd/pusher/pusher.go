@@ -38,12 +38,13 @@ func main() {
 		return
 	}
 
+	ctx := context.Background()
 	c := client.New(os.Args[1])
-	if err := c.Login(os.Args[2], os.Args[3], []string{"interactive", "publish"}); err != nil {
+	if err := c.Login(ctx, os.Args[2], os.Args[3], []string{"interactive", "publish"}); err != nil {
 		fmt.Printf("authentication failed: %v\n", err)
 		return
 	}
-	if err := c.SendMessage(os.Args[4], res); err != nil {
+	if err := c.SendMessage(ctx, os.Args[4], res); err != nil {
 		fmt.Printf("push failed: %v\n", err)
 		return
 	}
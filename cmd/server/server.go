@@ -1,12 +1,104 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/kennylevinsen/locshare/contacts"
+	"github.com/kennylevinsen/locshare/groups"
 	"github.com/kennylevinsen/locshare/server"
+	"github.com/kennylevinsen/locshare/sessions"
+	"github.com/kennylevinsen/locshare/users"
 )
 
 func main() {
-	s := server.NewServer()
-	http.ListenAndServe(":9000", s)
+	addr := flag.String("addr", ":9000", "address to listen on")
+	tcpAddr := flag.String("tcp", ":9001", "address to serve the framed TCP protocol on; disabled if empty")
+	data := flag.String("data", "", "directory to persist data in; kept in memory if empty")
+	certFile := flag.String("tls-cert", "", "certificate file to serve TLS with; plaintext if empty")
+	keyFile := flag.String("tls-key", "", "key file of the TLS certificate")
+	clientCAFile := flag.String("tls-client-ca", "", "CA certificates to accept client certificates from; disabled if empty")
+	admins := flag.String("admins", "", "comma separated list of users who may log in with the admin capability")
+	flag.Parse()
+
+	var cfg server.Config
+	if *admins != "" {
+		grants := sessions.DefaultGrantPolicy
+		grants.Admins = strings.Split(*admins, ",")
+		cfg.Grants = &grants
+	}
+	if *data != "" {
+		u, err := users.NewFileDB(filepath.Join(*data, "users"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open user database: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.Users = u
+
+		sess, err := sessions.NewFileDB(filepath.Join(*data, "sessions"), sessions.DefaultPolicy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open session database: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.Sessions = sess
+
+		c, err := contacts.NewFileDB(filepath.Join(*data, "contacts"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open contact database: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.Contacts = c
+
+		g, err := groups.NewFileDB(filepath.Join(*data, "groups"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open group database: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.Groups = g
+	}
+
+	s := server.NewServer(cfg)
+
+	var tlsConfig *tls.Config
+	if *certFile != "" {
+		var err error
+		tlsConfig, err = server.NewTLSConfig(*certFile, *keyFile, *clientCAFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to set up TLS: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *tcpAddr != "" {
+		l, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to listen for TCP: %v\n", err)
+			os.Exit(1)
+		}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		go s.ServeTCP(l)
+	}
+
+	hs := &http.Server{
+		Addr:      *addr,
+		Handler:   s,
+		TLSConfig: tlsConfig,
+	}
+
+	var err error
+	if tlsConfig != nil {
+		err = hs.ListenAndServeTLS("", "")
+	} else {
+		err = hs.ListenAndServe()
+	}
+	fmt.Fprintf(os.Stderr, "server failed: %v\n", err)
+	os.Exit(1)
 }
@@ -0,0 +1,195 @@
+package contacts
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/kennylevinsen/locshare/store"
+)
+
+// contactDB keeps, for every user, the contacts as seen by that user.
+type contactDB struct {
+	contactLock sync.RWMutex
+	contacts    map[string]map[string]Contact
+
+	store *store.Dir
+}
+
+// set updates the contact other of username, removing it if state is empty.
+// The caller must hold contactLock, and save the user afterwards.
+func (db *contactDB) set(username, other string, state State, incoming bool) {
+	m := db.contacts[username]
+	if state == "" {
+		delete(m, other)
+		return
+	}
+
+	if m == nil {
+		m = make(map[string]Contact)
+		db.contacts[username] = m
+	}
+	m[other] = Contact{Username: other, State: state, Incoming: incoming}
+}
+
+// save persists the contacts of the named users. The caller must hold
+// contactLock.
+func (db *contactDB) save(usernames ...string) error {
+	if db.store == nil {
+		return nil
+	}
+
+	for _, u := range usernames {
+		m := db.contacts[u]
+		if len(m) == 0 {
+			delete(db.contacts, u)
+			if err := db.store.Delete(u); err != nil && err != store.ErrNotFound {
+				return err
+			}
+			continue
+		}
+
+		list := make([]Contact, 0, len(m))
+		for _, c := range m {
+			list = append(list, c)
+		}
+		if err := db.store.Put(u, list); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *contactDB) Request(username, other string, hidden bool) error {
+	if username == other {
+		return ErrSelf
+	}
+
+	db.contactLock.Lock()
+	defer db.contactLock.Unlock()
+
+	mine := db.contacts[username][other]
+	switch {
+	case mine.State == Accepted:
+		return nil
+	case hidden:
+		db.set(username, other, Pending, false)
+	case mine.State == Pending && mine.Incoming:
+		db.set(username, other, Accepted, false)
+		db.set(other, username, Accepted, false)
+	default:
+		db.set(username, other, Pending, false)
+		db.set(other, username, Pending, true)
+	}
+
+	return db.save(username, other)
+}
+
+func (db *contactDB) Accept(username, other string) error {
+	db.contactLock.Lock()
+	defer db.contactLock.Unlock()
+
+	mine := db.contacts[username][other]
+	if mine.State != Pending || !mine.Incoming {
+		return ErrNotIncoming
+	}
+
+	db.set(username, other, Accepted, false)
+	db.set(other, username, Accepted, false)
+	return db.save(username, other)
+}
+
+func (db *contactDB) Remove(username, other string) error {
+	db.contactLock.Lock()
+	defer db.contactLock.Unlock()
+
+	if _, ok := db.contacts[username][other]; !ok {
+		return ErrNoSuchContact
+	}
+
+	db.set(username, other, "", false)
+	db.set(other, username, "", false)
+	return db.save(username, other)
+}
+
+func (db *contactDB) Get(username, other string) (Contact, error) {
+	db.contactLock.RLock()
+	defer db.contactLock.RUnlock()
+	c, ok := db.contacts[username][other]
+	if !ok {
+		return Contact{}, ErrNoSuchContact
+	}
+
+	return c, nil
+}
+
+func (db *contactDB) List(username string) ([]Contact, error) {
+	db.contactLock.RLock()
+	m := db.contacts[username]
+	list := make([]Contact, 0, len(m))
+	for _, c := range m {
+		list = append(list, c)
+	}
+	db.contactLock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Username < list[j].Username
+	})
+	return list, nil
+}
+
+func (db *contactDB) DelUser(username string) error {
+	db.contactLock.Lock()
+	defer db.contactLock.Unlock()
+
+	// Not every contact is stored on both sides, so all users are checked.
+	affected := []string{username}
+	delete(db.contacts, username)
+	for other, m := range db.contacts {
+		if _, ok := m[username]; ok {
+			db.set(other, username, "", false)
+			affected = append(affected, other)
+		}
+	}
+
+	return db.save(affected...)
+}
+
+func NewDB() ContactDB {
+	return &contactDB{
+		contacts: make(map[string]map[string]Contact),
+	}
+}
+
+// NewFileDB returns a ContactDB persisted in the directory at path.
+func NewFileDB(path string) (ContactDB, error) {
+	s, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	db := &contactDB{
+		contacts: make(map[string]map[string]Contact),
+		store:    s,
+	}
+
+	for _, k := range keys {
+		var list []Contact
+		if err := s.Get(k, &list); err != nil {
+			return nil, err
+		}
+
+		m := make(map[string]Contact, len(list))
+		for _, c := range list {
+			m[c.Username] = c
+		}
+		db.contacts[k] = m
+	}
+
+	return db, nil
+}
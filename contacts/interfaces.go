@@ -0,0 +1,47 @@
+package contacts
+
+import "errors"
+
+var (
+	ErrNoSuchContact = errors.New("no such contact")
+	ErrNotIncoming   = errors.New("no incoming request from contact")
+	ErrSelf          = errors.New("cannot be a contact of self")
+)
+
+// State is the state of a contact, as seen by one of the two users.
+type State string
+
+const (
+	// Pending contacts have a request awaiting an answer. Whether the user
+	// sent or received the request is told by Contact.Incoming.
+	Pending State = "pending"
+	// Accepted contacts have agreed to be contacts of each other.
+	Accepted State = "accepted"
+)
+
+type Contact struct {
+	Username string `json:"username"`
+	State    State  `json:"state"`
+	Incoming bool   `json:"incoming,omitempty"`
+}
+
+// ContactDB keeps the contacts of users. Blocks are kept by the users
+// package, and callers pass on what the contacts need to know of them.
+type ContactDB interface {
+	// Request asks other to become a contact of username. If other already
+	// asked username, both become accepted contacts. If hidden, other has
+	// blocked username, and the request looks pending to username without
+	// ever being seen by other.
+	Request(username, other string, hidden bool) error
+	// Accept accepts an incoming request from other.
+	Accept(username, other string) error
+	// Remove rejects or withdraws a request, or ends an accepted contact,
+	// on both sides.
+	Remove(username, other string) error
+
+	Get(username, other string) (Contact, error)
+	List(username string) ([]Contact, error)
+
+	// DelUser removes all contacts of a deleted user.
+	DelUser(username string) error
+}
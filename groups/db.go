@@ -0,0 +1,224 @@
+package groups
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"github.com/kennylevinsen/locshare/store"
+)
+
+type groupDB struct {
+	groupLock sync.RWMutex
+	groups    map[string]*Group
+
+	store *store.Dir
+}
+
+// copyGroup returns a copy of g that does not share slices with it.
+func copyGroup(g *Group) Group {
+	c := *g
+	c.Members = append([]string(nil), g.Members...)
+	c.Invited = append([]string(nil), g.Invited...)
+	return c
+}
+
+// save persists a group. The caller must hold groupLock.
+func (db *groupDB) save(g *Group) error {
+	if db.store == nil {
+		return nil
+	}
+	return db.store.Put(g.ID, g)
+}
+
+// drop removes a group. The caller must hold groupLock.
+func (db *groupDB) drop(id string) error {
+	if db.store != nil {
+		err := db.store.Delete(id)
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+
+	delete(db.groups, id)
+	return nil
+}
+
+func (db *groupDB) New(owner, name string) (Group, error) {
+	db.groupLock.Lock()
+	defer db.groupLock.Unlock()
+
+	var id string
+	for id == "" || db.groups[id] != nil {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return Group{}, err
+		}
+		id = hex.EncodeToString(b)
+	}
+
+	g := &Group{
+		ID:      id,
+		Name:    name,
+		Owner:   owner,
+		Members: []string{owner},
+		Invited: []string{},
+	}
+
+	if err := db.save(g); err != nil {
+		return Group{}, err
+	}
+
+	db.groups[id] = g
+	return copyGroup(g), nil
+}
+
+func (db *groupDB) Get(id string) (Group, error) {
+	db.groupLock.RLock()
+	defer db.groupLock.RUnlock()
+	g := db.groups[id]
+	if g == nil {
+		return Group{}, ErrNoSuchGroup
+	}
+
+	return copyGroup(g), nil
+}
+
+func (db *groupDB) Del(id string) error {
+	db.groupLock.Lock()
+	defer db.groupLock.Unlock()
+	if db.groups[id] == nil {
+		return ErrNoSuchGroup
+	}
+
+	return db.drop(id)
+}
+
+func (db *groupDB) Invite(id, username string) error {
+	db.groupLock.Lock()
+	defer db.groupLock.Unlock()
+	g := db.groups[id]
+	if g == nil {
+		return ErrNoSuchGroup
+	}
+
+	if g.IsMember(username) {
+		return ErrAlreadyMember
+	}
+	if g.IsInvited(username) {
+		return nil
+	}
+
+	g.Invited = append(g.Invited, username)
+	return db.save(g)
+}
+
+func (db *groupDB) Join(id, username string) error {
+	db.groupLock.Lock()
+	defer db.groupLock.Unlock()
+	g := db.groups[id]
+	if g == nil {
+		return ErrNoSuchGroup
+	}
+
+	if !g.IsInvited(username) {
+		return ErrNotInvited
+	}
+
+	g.Invited = without(g.Invited, username)
+	g.Members = append(g.Members, username)
+	return db.save(g)
+}
+
+func (db *groupDB) Leave(id, username string) error {
+	db.groupLock.Lock()
+	defer db.groupLock.Unlock()
+	g := db.groups[id]
+	if g == nil {
+		return ErrNoSuchGroup
+	}
+
+	if g.Owner == username {
+		return db.drop(id)
+	}
+
+	if !g.IsMember(username) && !g.IsInvited(username) {
+		return ErrNotMember
+	}
+
+	g.Members = without(g.Members, username)
+	g.Invited = without(g.Invited, username)
+	return db.save(g)
+}
+
+func (db *groupDB) ForUser(username string) ([]Group, error) {
+	db.groupLock.RLock()
+	var list []Group
+	for _, g := range db.groups {
+		if g.IsMember(username) || g.IsInvited(username) {
+			list = append(list, copyGroup(g))
+		}
+	}
+	db.groupLock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+func (db *groupDB) DelUser(username string) error {
+	db.groupLock.Lock()
+	defer db.groupLock.Unlock()
+	for id, g := range db.groups {
+		switch {
+		case g.Owner == username:
+			if err := db.drop(id); err != nil {
+				return err
+			}
+		case g.IsMember(username), g.IsInvited(username):
+			g.Members = without(g.Members, username)
+			g.Invited = without(g.Invited, username)
+			if err := db.save(g); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func NewDB() GroupDB {
+	return &groupDB{
+		groups: make(map[string]*Group),
+	}
+}
+
+// NewFileDB returns a GroupDB persisted in the directory at path.
+func NewFileDB(path string) (GroupDB, error) {
+	s, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	db := &groupDB{
+		groups: make(map[string]*Group),
+		store:  s,
+	}
+
+	for _, k := range keys {
+		var g Group
+		if err := s.Get(k, &g); err != nil {
+			return nil, err
+		}
+		db.groups[g.ID] = &g
+	}
+
+	return db, nil
+}
@@ -0,0 +1,69 @@
+package groups
+
+import "errors"
+
+var (
+	ErrNoSuchGroup   = errors.New("no such group")
+	ErrNotMember     = errors.New("not a member of group")
+	ErrNotInvited    = errors.New("not invited to group")
+	ErrAlreadyMember = errors.New("already a member of group")
+	ErrNotOwner      = errors.New("not the owner of group")
+)
+
+// Group is a named circle of users. The owner is always a member. Users
+// become members by accepting an invitation from the owner.
+type Group struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+	Invited []string `json:"invited"`
+}
+
+// IsMember reports whether username is a member of the group.
+func (g Group) IsMember(username string) bool {
+	return contains(g.Members, username)
+}
+
+// IsInvited reports whether username has an open invitation to the group.
+func (g Group) IsInvited(username string) bool {
+	return contains(g.Invited, username)
+}
+
+type GroupDB interface {
+	New(owner, name string) (Group, error)
+	Get(id string) (Group, error)
+	Del(id string) error
+
+	// Invite invites username to the group, and Join accepts the
+	// invitation. Leave removes a member or invitation, deleting the group
+	// if the owner leaves.
+	Invite(id, username string) error
+	Join(id, username string) error
+	Leave(id, username string) error
+
+	// ForUser lists the groups username is a member of or invited to.
+	ForUser(username string) ([]Group, error)
+
+	// DelUser removes a deleted user from all groups.
+	DelUser(username string) error
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func without(list []string, s string) []string {
+	res := make([]string, 0, len(list))
+	for _, l := range list {
+		if l != s {
+			res = append(res, l)
+		}
+	}
+	return res
+}
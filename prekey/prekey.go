@@ -0,0 +1,111 @@
+// Package prekey verifies the signatures of signed prekeys, the temporary keys
+// users publish for others to start conversations with, against the identity
+// keys of their users.
+//
+// Identity keys are either 32 byte Ed25519 public keys, verified as Ed25519
+// signatures, or 33 byte Curve25519 public keys prefixed by the type byte
+// 0x05 as used by Signal, verified as XEdDSA signatures the way libsignal
+// makes them: the sign bit of the Edwards form of the key is carried in the
+// otherwise unused top bit of the signature. Signatures are 64 bytes, and
+// cover the prekey exactly as uploaded.
+package prekey
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"math/big"
+)
+
+const (
+	// Curve25519Type prefixes Curve25519 identity keys.
+	Curve25519Type = 0x05
+
+	SignatureSize = 64
+)
+
+var (
+	ErrInvalidIdentity  = errors.New("prekey: identity key is neither an Ed25519 nor a Curve25519 key")
+	ErrInvalidSignature = errors.New("prekey: invalid signature")
+)
+
+// CheckIdentity returns ErrInvalidIdentity if identity cannot verify
+// signatures.
+func CheckIdentity(identity []byte) error {
+	_, err := verificationKey(identity)
+	return err
+}
+
+// Verify checks that signature is a signature of prekey by identity.
+func Verify(identity, prekey, signature []byte) error {
+	pub, err := verificationKey(identity)
+	if err != nil {
+		return err
+	}
+
+	if len(signature) != SignatureSize {
+		return ErrInvalidSignature
+	}
+
+	if len(identity) != ed25519.PublicKeySize {
+		// Move the sign bit from the signature to the key, which was
+		// converted with a sign bit of zero.
+		pub[31] |= signature[63] & 0x80
+		signature = append([]byte(nil), signature...)
+		signature[63] &= 0x7f
+	}
+
+	if !ed25519.Verify(pub, prekey, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// verificationKey returns the Ed25519 key to verify the signatures of
+// identity with.
+func verificationKey(identity []byte) (ed25519.PublicKey, error) {
+	switch {
+	case len(identity) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(identity), nil
+	case len(identity) == 33 && identity[0] == Curve25519Type:
+		return montgomeryToEdwards(identity[1:])
+	default:
+		return nil, ErrInvalidIdentity
+	}
+}
+
+// p is the prime 2^255 - 19 of the field of Curve25519.
+var p, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// montgomeryToEdwards converts the Curve25519 public key u to the Ed25519
+// public key with y = (u - 1) / (u + 1) and a sign bit of zero. The sign bit
+// cannot be told from u, and is set by Verify.
+func montgomeryToEdwards(u []byte) (ed25519.PublicKey, error) {
+	// Keys are little endian.
+	be := make([]byte, len(u))
+	for i, b := range u {
+		be[len(u)-1-i] = b
+	}
+	be[0] &= 0x7f
+
+	x := new(big.Int).SetBytes(be)
+	if x.Cmp(p) >= 0 {
+		return nil, ErrInvalidIdentity
+	}
+
+	num := new(big.Int).Sub(x, big.NewInt(1))
+	den := new(big.Int).Add(x, big.NewInt(1))
+	den.Mod(den, p)
+	if den.Sign() == 0 {
+		return nil, ErrInvalidIdentity
+	}
+
+	y := num.Mul(num, den.ModInverse(den, p))
+	y.Mod(y, p)
+
+	pub := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	yb := y.Bytes()
+	for i, b := range yb {
+		pub[len(yb)-1-i] = b
+	}
+	return pub, nil
+}
@@ -0,0 +1,88 @@
+package prekey
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test vectors 1 to 3 of RFC 8032, section 7.1.
+var ed25519Vectors = []struct {
+	pub, msg, sig string
+}{
+	{
+		"d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+		"",
+		"e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b",
+	},
+	{
+		"3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c",
+		"72",
+		"92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00",
+	},
+	{
+		"fc51cd8e6218a1a38da47ed00230f0580816ed13ba3303ac5deb911548908025",
+		"af82",
+		"6291d657deec24024827e69c3abe01a30ce548a284743a445e3680d7db5ac3ac18ff9b538d16f290ae67f760984dc6594a7c15e9716ed28dc027beceea1ec40a",
+	},
+}
+
+// An identity key, a signed prekey and its signature made by libsignal. The
+// Edwards form of the identity key has its sign bit set, which the signature
+// carries.
+const (
+	signalIdentity = "05ab7e717d4a163b7d9a1d8071dfe9dcf8cdcd1cea3339b6356be84d887e322c64"
+	signalPrekey   = "05edce9d9c415ca78cb7252e72c2c4a554d3eb29485a0e1d503118d1a82d99fb4a"
+	signalSig      = "5de88ca9a89b4a115da79109c67c9c7464a3e4180274f1cb8c63c2984e286dfbede82deb9dcd9fae0bfbb821569b3d9001bd8130cd11d486cef047bd60b86e88"
+)
+
+func TestVerifyEd25519(t *testing.T) {
+	for i, v := range ed25519Vectors {
+		pub, msg, sig := unhex(t, v.pub), unhex(t, v.msg), unhex(t, v.sig)
+		if err := Verify(pub, msg, sig); err != nil {
+			t.Errorf("vector %d: %v", i+1, err)
+		}
+
+		sig[0] ^= 1
+		if err := Verify(pub, msg, sig); err != ErrInvalidSignature {
+			t.Errorf("vector %d with corrupt signature: got %v, want ErrInvalidSignature", i+1, err)
+		}
+	}
+}
+
+func TestVerifyXEdDSA(t *testing.T) {
+	identity, prekey, sig := unhex(t, signalIdentity), unhex(t, signalPrekey), unhex(t, signalSig)
+	if err := Verify(identity, prekey, sig); err != nil {
+		t.Fatalf("libsignal signature: %v", err)
+	}
+
+	// Verify must not clear the sign bit of the caller's signature.
+	if sig[63]&0x80 == 0 {
+		t.Fatal("signature modified by Verify")
+	}
+
+	sig[63] ^= 0x80
+	if err := Verify(identity, prekey, sig); err != ErrInvalidSignature {
+		t.Fatalf("signature with flipped sign bit: got %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestCheckIdentity(t *testing.T) {
+	for _, identity := range []string{
+		"",
+		"06ab7e717d4a163b7d9a1d8071dfe9dcf8cdcd1cea3339b6356be84d887e322c64",
+		"ab7e717d4a163b7d9a1d8071dfe9dcf8cdcd1cea3339b6356be84d887e322c",
+	} {
+		if err := CheckIdentity(unhex(t, identity)); err != ErrInvalidIdentity {
+			t.Errorf("identity %q: got %v, want ErrInvalidIdentity", identity, err)
+		}
+	}
+}
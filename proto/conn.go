@@ -0,0 +1,121 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The hello exchange negotiates the version of a connection. The client sends
+// a hello frame with the highest version it supports in "v", and the server
+// answers with a hello frame holding the version to use, which is the highest
+// version both support. Both frames use the version in use before the
+// exchange, and both sides switch once it is done. Servers that do not know
+// hello answer with an error frame, leaving the version unchanged.
+const (
+	MethodHello = "hello"
+	MethodError = "error"
+	KeyMethod   = "m"
+	KeyVersion  = "v"
+	KeyError    = "error"
+)
+
+// Conn reads and writes frames of the negotiated version. It is not safe for
+// concurrent use, except that one goroutine may read while another writes.
+type Conn struct {
+	rw io.ReadWriter
+
+	// Version is the framing version in use. It starts out as Version1.
+	Version int
+
+	// MaxFrameSize is the largest frame that is read. Version 1 frames are
+	// further limited to 65535 bytes.
+	MaxFrameSize int
+}
+
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{
+		rw:           rw,
+		Version:      Version1,
+		MaxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+func (c *Conn) Read() (map[string]string, error) {
+	switch c.Version {
+	case Version1:
+		max := c.MaxFrameSize
+		if max > maxFrameSizeV1 {
+			max = maxFrameSizeV1
+		}
+		return protoRead(c.rw, max)
+	case Version2:
+		return ProtoReadV2(c.rw, c.MaxFrameSize)
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+}
+
+func (c *Conn) Write(data map[string]string) error {
+	switch c.Version {
+	case Version1:
+		return ProtoWrite(data, c.rw)
+	case Version2:
+		return ProtoWriteV2(data, c.rw)
+	default:
+		return ErrUnsupportedVersion
+	}
+}
+
+// Hello negotiates the highest version supported by both ends, and switches
+// to it. It must be the first exchange on the connection.
+func (c *Conn) Hello() error {
+	req := map[string]string{
+		KeyMethod:  MethodHello,
+		KeyVersion: strconv.Itoa(MaxVersion),
+	}
+	if err := c.Write(req); err != nil {
+		return err
+	}
+
+	resp, err := c.Read()
+	if err != nil {
+		return err
+	}
+
+	switch resp[KeyMethod] {
+	case MethodHello:
+	case MethodError:
+		// The server predates hello, and only speaks version 1.
+		return nil
+	default:
+		return fmt.Errorf("proto: unexpected response to hello: %q", resp[KeyMethod])
+	}
+
+	v, err := strconv.Atoi(resp[KeyVersion])
+	if err != nil || v < Version1 || v > MaxVersion {
+		return ErrUnsupportedVersion
+	}
+
+	c.Version = v
+	return nil
+}
+
+// Negotiate answers a hello frame received by a server, returning the frame
+// to answer it with and the version to switch to once it has been written.
+func Negotiate(hello map[string]string) (map[string]string, int, error) {
+	v, err := strconv.Atoi(hello[KeyVersion])
+	if err != nil || v < Version1 {
+		return nil, 0, errors.New("proto: invalid version in hello")
+	}
+	if v > MaxVersion {
+		v = MaxVersion
+	}
+
+	resp := map[string]string{
+		KeyMethod:  MethodHello,
+		KeyVersion: strconv.Itoa(v),
+	}
+	return resp, v, nil
+}
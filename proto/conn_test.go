@@ -0,0 +1,143 @@
+package proto
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// serve answers the first frame read from conn with answer, and switches to
+// version once the answer is written.
+func serve(t *testing.T, conn net.Conn, answer func(req map[string]string) (map[string]string, int)) <-chan *Conn {
+	done := make(chan *Conn, 1)
+	go func() {
+		c := NewConn(conn)
+		req, err := c.Read()
+		if err != nil {
+			t.Errorf("server: reading hello: %v", err)
+			close(done)
+			return
+		}
+
+		resp, v := answer(req)
+		if err := c.Write(resp); err != nil {
+			t.Errorf("server: writing answer: %v", err)
+		}
+		c.Version = v
+		done <- c
+	}()
+	return done
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		hello   string
+		version int
+		fail    bool
+	}{
+		{"1", Version1, false},
+		{"2", Version2, false},
+		{"9", MaxVersion, false},
+		{"0", 0, true},
+		{"", 0, true},
+		{"two", 0, true},
+	}
+
+	for _, tt := range tests {
+		resp, v, err := Negotiate(map[string]string{KeyMethod: MethodHello, KeyVersion: tt.hello})
+		if tt.fail {
+			if err == nil {
+				t.Errorf("hello %q: negotiated %d, want error", tt.hello, v)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("hello %q: %v", tt.hello, err)
+			continue
+		}
+		if v != tt.version || resp[KeyVersion] != strconv.Itoa(tt.version) || resp[KeyMethod] != MethodHello {
+			t.Errorf("hello %q: got %d %v, want %d", tt.hello, v, resp, tt.version)
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := serve(t, server, func(req map[string]string) (map[string]string, int) {
+		resp, v, err := Negotiate(req)
+		if err != nil {
+			t.Errorf("server: %v", err)
+		}
+		return resp, v
+	})
+
+	c := NewConn(client)
+	if err := c.Hello(); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	if c.Version != MaxVersion {
+		t.Fatalf("negotiated version %d, want %d", c.Version, MaxVersion)
+	}
+
+	sc := <-done
+	if sc == nil {
+		t.FailNow()
+	}
+
+	// Frames too large for version 1 pass once version 2 is in use.
+	want := map[string]string{"msg": string(make([]byte, 1000))}
+	go func() {
+		if err := c.Write(want); err != nil {
+			t.Errorf("writing: %v", err)
+		}
+	}()
+	got, err := sc.Read()
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if got["msg"] != want["msg"] {
+		t.Fatal("frame not read back")
+	}
+}
+
+func TestHelloOldServer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := serve(t, server, func(req map[string]string) (map[string]string, int) {
+		return map[string]string{KeyMethod: MethodError, KeyError: "unknown method"}, Version1
+	})
+
+	c := NewConn(client)
+	if err := c.Hello(); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	if c.Version != Version1 {
+		t.Fatalf("negotiated version %d, want %d", c.Version, Version1)
+	}
+	<-done
+}
+
+func TestHelloInvalidVersion(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := serve(t, server, func(req map[string]string) (map[string]string, int) {
+		return map[string]string{KeyMethod: MethodHello, KeyVersion: "9"}, Version1
+	})
+
+	c := NewConn(client)
+	if err := c.Hello(); err != ErrUnsupportedVersion {
+		t.Fatalf("got %v, want ErrUnsupportedVersion", err)
+	}
+	if c.Version != Version1 {
+		t.Fatalf("version changed to %d", c.Version)
+	}
+	<-done
+}
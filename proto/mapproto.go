@@ -1,69 +1,255 @@
+// Package proto implements the framing of the TCP protocol. A frame carries a
+// set of string keys and values.
+//
+// Version 1 frames start with a big endian uint16 holding the length of the
+// rest of the frame, followed by the pairs, each key and value prefixed by a
+// single byte length. Keys and values are thus limited to 255 bytes.
+//
+// Version 2 frames start with the version byte 2 and the length of the rest
+// of the frame as an unsigned varint, followed by the pairs, each key and
+// value prefixed by its length as an unsigned varint.
+//
+// Connections start out with version 1, and switch to a later version by
+// negotiating it with a hello exchange. See Conn.
 package proto
 
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
+const (
+	Version1 = 1
+	Version2 = 2
+
+	// MaxVersion is the highest version implemented.
+	MaxVersion = Version2
+
+	// DefaultMaxFrameSize is the largest frame read by a Conn, unless
+	// configured otherwise.
+	DefaultMaxFrameSize = 128 << 10
+
+	maxFrameSizeV1 = 1<<16 - 1
+	maxFieldSizeV1 = 1<<8 - 1
+)
+
+var (
+	ErrFrameTooLarge      = errors.New("proto: frame too large")
+	ErrFieldTooLarge      = errors.New("proto: key or value too large for version")
+	ErrTruncatedFrame     = errors.New("proto: key or value exceeds frame")
+	ErrDuplicateKey       = errors.New("proto: duplicate key")
+	ErrUnsupportedVersion = errors.New("proto: unsupported version")
+	ErrInvalidLength      = errors.New("proto: invalid length")
+)
+
+// ProtoWrite writes data as a version 1 frame. Keys and values longer than 255
+// bytes cannot be written, and return ErrFieldTooLarge.
 func ProtoWrite(data map[string]string, c io.Writer) error {
 	b := new(bytes.Buffer)
 	b.Write([]byte{0, 0}) // dummy length
 
 	for k, v := range data {
-		b.Write([]byte{byte(len(k))})
-		b.Write([]byte(k))
-		b.Write([]byte{byte(len(v))})
-		b.Write([]byte(v))
+		if len(k) > maxFieldSizeV1 || len(v) > maxFieldSizeV1 {
+			return ErrFieldTooLarge
+		}
+		b.WriteByte(byte(len(k)))
+		b.WriteString(k)
+		b.WriteByte(byte(len(v)))
+		b.WriteString(v)
 	}
 
 	bytes := b.Bytes()
+	if len(bytes)-2 > maxFrameSizeV1 {
+		return ErrFrameTooLarge
+	}
 	binary.BigEndian.PutUint16(bytes, uint16(len(bytes)-2))
 
 	_, err := c.Write(bytes)
 	return err
 }
 
+// ProtoRead reads a version 1 frame.
 func ProtoRead(c io.Reader) (map[string]string, error) {
-	header := make([]byte, 2)
-	param_header := make([]byte, 1)
+	return protoRead(c, maxFrameSizeV1)
+}
 
-	_, err := io.ReadFull(c, header)
-	if err != nil {
+func protoRead(c io.Reader, maxFrameSize int) (map[string]string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c, header); err != nil {
 		return nil, err
 	}
 
-	l := binary.BigEndian.Uint16(header)
+	l := int(binary.BigEndian.Uint16(header))
+	if l > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, l)
+	if _, err := io.ReadFull(c, frame); err != nil {
+		return nil, unexpectedEOF(err)
+	}
 
 	data := make(map[string]string)
+	for len(frame) > 0 {
+		var key, value []byte
+		var err error
+		if key, frame, err = splitV1(frame); err != nil {
+			return nil, err
+		}
+		if value, frame, err = splitV1(frame); err != nil {
+			return nil, err
+		}
 
-	for l > 0 {
-		if _, err := io.ReadFull(c, param_header); err != nil {
+		if err := add(data, key, value); err != nil {
 			return nil, err
 		}
+	}
+
+	return data, nil
+}
+
+// splitV1 splits a length prefixed field off the start of frame.
+func splitV1(frame []byte) ([]byte, []byte, error) {
+	if len(frame) < 1 {
+		return nil, nil, ErrTruncatedFrame
+	}
+
+	l := int(frame[0])
+	frame = frame[1:]
+	if l > len(frame) {
+		return nil, nil, ErrTruncatedFrame
+	}
+	return frame[:l], frame[l:], nil
+}
+
+// ProtoWriteV2 writes data as a version 2 frame.
+func ProtoWriteV2(data map[string]string, c io.Writer) error {
+	body := new(bytes.Buffer)
+	var lb [binary.MaxVarintLen64]byte
+	for k, v := range data {
+		body.Write(lb[:binary.PutUvarint(lb[:], uint64(len(k)))])
+		body.WriteString(k)
+		body.Write(lb[:binary.PutUvarint(lb[:], uint64(len(v)))])
+		body.WriteString(v)
+	}
 
-		key_len := uint8(param_header[0])
-		key := make([]byte, key_len)
+	b := new(bytes.Buffer)
+	b.WriteByte(Version2)
+	b.Write(lb[:binary.PutUvarint(lb[:], uint64(body.Len()))])
+	b.Write(body.Bytes())
+
+	_, err := c.Write(b.Bytes())
+	return err
+}
 
-		if _, err := io.ReadFull(c, key); err != nil {
+// ProtoReadV2 reads a version 2 frame. Frames longer than maxFrameSize are
+// rejected with ErrFrameTooLarge before they are read.
+func ProtoReadV2(c io.Reader, maxFrameSize int) (map[string]string, error) {
+	br := byteReader{c}
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != Version2 {
+		return nil, ErrUnsupportedVersion
+	}
+
+	l, err := readUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(maxFrameSize) {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, l)
+	if _, err := io.ReadFull(c, frame); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	data := make(map[string]string)
+	for len(frame) > 0 {
+		var key, value []byte
+		if key, frame, err = splitV2(frame); err != nil {
+			return nil, err
+		}
+		if value, frame, err = splitV2(frame); err != nil {
 			return nil, err
 		}
 
-		if _, err := io.ReadFull(c, param_header); err != nil {
+		if err := add(data, key, value); err != nil {
 			return nil, err
 		}
+	}
 
-		value_len := uint8(param_header[0])
-		value := make([]byte, value_len)
+	return data, nil
+}
 
-		if _, err := io.ReadFull(c, value); err != nil {
-			return nil, err
+// splitV2 splits a varint length prefixed field off the start of frame.
+func splitV2(frame []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(frame)
+	if n <= 0 {
+		if n == 0 {
+			return nil, nil, ErrTruncatedFrame
 		}
+		return nil, nil, ErrInvalidLength
+	}
 
-		l -= uint16(value_len + key_len + 2)
+	frame = frame[n:]
+	if l > uint64(len(frame)) {
+		return nil, nil, ErrTruncatedFrame
+	}
+	return frame[:l], frame[l:], nil
+}
 
-		data[string(key)] = string(value)
+func add(data map[string]string, key, value []byte) error {
+	if _, ok := data[string(key)]; ok {
+		return ErrDuplicateKey
 	}
+	data[string(key)] = string(value)
+	return nil
+}
 
-	return data, nil
+// unexpectedEOF turns an EOF in the middle of a frame into
+// io.ErrUnexpectedEOF, as only EOF between frames is a clean end of stream.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readUvarint reads an unsigned varint.
+func readUvarint(br byteReader) (uint64, error) {
+	var x uint64
+	var shift uint
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				return 0, ErrInvalidLength
+			}
+			return x | uint64(b)<<shift, nil
+		}
+		x |= uint64(b&0x7f) << shift
+		shift += 7
+	}
+	return 0, ErrInvalidLength
+}
+
+// byteReader reads single bytes from an io.Reader without buffering, so no
+// more than the frame is consumed.
+type byteReader struct {
+	io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(br.Reader, b[:])
+	return b[0], err
 }
@@ -0,0 +1,119 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []map[string]string{
+		{},
+		{"m": "publish"},
+		{"m": "publish", "to": "alice", "msg": "hello"},
+		{"": ""},
+		{"k": strings.Repeat("v", 255)},
+	}
+
+	for _, data := range tests {
+		b := new(bytes.Buffer)
+		if err := ProtoWrite(data, b); err != nil {
+			t.Fatalf("v1: writing %v: %v", data, err)
+		}
+		got, err := ProtoRead(b)
+		if err != nil {
+			t.Fatalf("v1: reading %v: %v", data, err)
+		}
+		if !reflect.DeepEqual(got, data) {
+			t.Errorf("v1: got %v, want %v", got, data)
+		}
+
+		b.Reset()
+		if err := ProtoWriteV2(data, b); err != nil {
+			t.Fatalf("v2: writing %v: %v", data, err)
+		}
+		got, err = ProtoReadV2(b, DefaultMaxFrameSize)
+		if err != nil {
+			t.Fatalf("v2: reading %v: %v", data, err)
+		}
+		if !reflect.DeepEqual(got, data) {
+			t.Errorf("v2: got %v, want %v", got, data)
+		}
+	}
+}
+
+func TestRoundTripLargeV2(t *testing.T) {
+	data := map[string]string{"msg": strings.Repeat("x", 70000)}
+
+	b := new(bytes.Buffer)
+	if err := ProtoWrite(data, b); err != ErrFieldTooLarge {
+		t.Fatalf("v1: got %v, want ErrFieldTooLarge", err)
+	}
+
+	if err := ProtoWriteV2(data, b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ProtoReadV2(b, DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Error("large value not read back")
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		v2    bool
+		frame []byte
+		want  error
+	}{
+		{"v1 empty stream", false, nil, io.EOF},
+		{"v1 short header", false, []byte{0}, io.ErrUnexpectedEOF},
+		{"v1 short frame", false, []byte{0, 4, 1, 'k'}, io.ErrUnexpectedEOF},
+		{"v1 truncated key", false, []byte{0, 2, 5, 'k'}, ErrTruncatedFrame},
+		{"v1 missing value", false, []byte{0, 2, 1, 'k'}, ErrTruncatedFrame},
+		{"v1 truncated value", false, []byte{0, 4, 1, 'k', 3, 'v'}, ErrTruncatedFrame},
+		{"v1 duplicate key", false, []byte{0, 8, 1, 'k', 1, 'a', 1, 'k', 1, 'b'}, ErrDuplicateKey},
+
+		{"v2 empty stream", true, nil, io.EOF},
+		{"v2 wrong version", true, []byte{Version1, 0}, ErrUnsupportedVersion},
+		{"v2 missing length", true, []byte{Version2}, io.ErrUnexpectedEOF},
+		{"v2 unterminated length", true, []byte{Version2, 0x80}, io.ErrUnexpectedEOF},
+		{"v2 overlong length", true, []byte{Version2, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, ErrInvalidLength},
+		{"v2 short frame", true, []byte{Version2, 4, 1, 'k'}, io.ErrUnexpectedEOF},
+		{"v2 truncated key", true, []byte{Version2, 2, 5, 'k'}, ErrTruncatedFrame},
+		{"v2 missing value", true, []byte{Version2, 2, 1, 'k'}, ErrTruncatedFrame},
+		{"v2 unterminated field length", true, []byte{Version2, 1, 0x80}, ErrTruncatedFrame},
+		{"v2 duplicate key", true, []byte{Version2, 8, 1, 'k', 1, 'a', 1, 'k', 1, 'b'}, ErrDuplicateKey},
+	}
+
+	for _, tt := range tests {
+		var err error
+		if tt.v2 {
+			_, err = ProtoReadV2(bytes.NewReader(tt.frame), DefaultMaxFrameSize)
+		} else {
+			_, err = ProtoRead(bytes.NewReader(tt.frame))
+		}
+		if err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestOversizeFrame checks that frames larger than the limit are rejected
+// from their header, without waiting for the rest of the frame.
+func TestOversizeFrame(t *testing.T) {
+	if _, err := ProtoReadV2(bytes.NewReader([]byte{Version2, 0x81, 0x01}), 128); err != ErrFrameTooLarge {
+		t.Errorf("v2: got %v, want ErrFrameTooLarge", err)
+	}
+
+	c := NewConn(bytes.NewBuffer([]byte{0, 17}))
+	c.MaxFrameSize = 16
+	if _, err := c.Read(); err != ErrFrameTooLarge {
+		t.Errorf("v1: got %v, want ErrFrameTooLarge", err)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/kennylevinsen/locshare/api"
+	"github.com/kennylevinsen/locshare/contacts"
+	"github.com/kennylevinsen/locshare/groups"
+	"github.com/kennylevinsen/locshare/prekey"
+	"github.com/kennylevinsen/locshare/sessions"
+	"github.com/kennylevinsen/locshare/users"
+)
+
+// errorStatus is the HTTP status sent with each error code. Codes missing
+// from it are sent as ProcessingError.
+var errorStatus = map[api.ErrorCode]int{
+	api.CodeInvalidRequest:      InvalidRequest,
+	api.CodeInvalidCapabilities: InvalidRequest,
+	api.CodeInvalidIdentityKey:  InvalidRequest,
+	api.CodeInvalidSignature:    InvalidRequest,
+	api.CodeTooLarge:            TooLarge,
+
+	api.CodeAuthFailed:          PermissionDenied,
+	api.CodeAuthRateLimited:     RateLimited,
+	api.CodeNoSession:           PermissionDenied,
+	api.CodeSessionExpired:      PermissionDenied,
+	api.CodeRefreshTokenInvalid: PermissionDenied,
+	api.CodeRefreshTokenReused:  PermissionDenied,
+
+	api.CodeAccessDenied:         Forbidden,
+	api.CodeCapabilityMissing:    Forbidden,
+	api.CodeCapabilityNotGranted: Forbidden,
+	api.CodeSharingNotAllowed:    Forbidden,
+	api.CodeNotOwner:             Forbidden,
+	api.CodeNotMember:            Forbidden,
+	api.CodeNotInvited:           Forbidden,
+
+	api.CodeNoSuchUser:    NoSuchEntity,
+	api.CodeNoSuchSession: NoSuchEntity,
+	api.CodeNoSuchDevice:  NoSuchEntity,
+	api.CodeNoSuchGroup:   NoSuchEntity,
+	api.CodeNoSuchContact: NoSuchEntity,
+	api.CodeNoSuchRequest: NoSuchEntity,
+	api.CodeNoSuchKey:     NoSuchEntity,
+	api.CodeNoIdentityKey: NoSuchEntity,
+	api.CodeNoPrekeys:     NoSuchEntity,
+	api.CodeNotBlocked:    NoSuchEntity,
+
+	api.CodeUserExists:    Conflict,
+	api.CodeKeyIDInUse:    Conflict,
+	api.CodeAlreadyMember: Conflict,
+
+	api.CodeRateLimited:   RateLimited,
+	api.CodeQuotaExceeded: RateLimited,
+
+	api.CodeInternal: ProcessingError,
+}
+
+// errorCodes maps the errors of the databases to the codes reported for them.
+var errorCodes = []struct {
+	err  error
+	code api.ErrorCode
+}{
+	{users.ErrNoSuchUser, api.CodeNoSuchUser},
+	{users.ErrUserAlreadyExists, api.CodeUserExists},
+	{users.ErrNoSuchRequest, api.CodeNoSuchRequest},
+	{users.ErrNotBlocked, api.CodeNotBlocked},
+	{users.ErrBlocked, api.CodeSharingNotAllowed},
+	{users.ErrRateLimited, api.CodeRateLimited},
+	{users.ErrNoSuchDevice, api.CodeNoSuchDevice},
+	{users.ErrQuotaExceeded, api.CodeQuotaExceeded},
+	{users.ErrAuthFailed, api.CodeAuthFailed},
+	{users.ErrAuthRateLimited, api.CodeAuthRateLimited},
+	{users.ErrNoIdentityKey, api.CodeNoIdentityKey},
+	{users.ErrNoSignedKey, api.CodeNoPrekeys},
+	{users.ErrNoOneTimeKeys, api.CodeNoPrekeys},
+	{users.ErrNoSuchKey, api.CodeNoSuchKey},
+	{users.ErrKeyIDInUse, api.CodeKeyIDInUse},
+
+	{sessions.ErrNoSuchSession, api.CodeNoSuchSession},
+	{sessions.ErrSessionExpired, api.CodeSessionExpired},
+	{sessions.ErrNoSuchCapability, api.CodeCapabilityMissing},
+	{sessions.ErrRefreshTokenReused, api.CodeRefreshTokenReused},
+
+	{contacts.ErrNoSuchContact, api.CodeNoSuchContact},
+	{contacts.ErrNotIncoming, api.CodeNoSuchRequest},
+	{contacts.ErrSelf, api.CodeInvalidRequest},
+
+	{prekey.ErrInvalidIdentity, api.CodeInvalidIdentityKey},
+	{prekey.ErrInvalidSignature, api.CodeInvalidSignature},
+
+	{groups.ErrNoSuchGroup, api.CodeNoSuchGroup},
+	{groups.ErrNotMember, api.CodeNotMember},
+	{groups.ErrNotInvited, api.CodeNotInvited},
+	{groups.ErrAlreadyMember, api.CodeAlreadyMember},
+	{groups.ErrNotOwner, api.CodeNotOwner},
+}
+
+// errorCode returns the code of err, or fallback if it is not a known error.
+func errorCode(err error, fallback api.ErrorCode) api.ErrorCode {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return fallback
+}
+
+func statusOf(code api.ErrorCode) int {
+	if status, ok := errorStatus[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kennylevinsen/locshare/api"
+)
+
+// capTTL returns the time-to-live of a message published with a ttl of secs
+// seconds. Messages without a ttl get the default, and those with one above
+// the server maximum get the maximum.
+func (s *Server) capTTL(secs uint64) time.Duration {
+	if secs == 0 {
+		return s.defaultTTL
+	}
+	if secs >= uint64(s.maxTTL/time.Second) {
+		return s.maxTTL
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// messageTTL parses the value of a TTLHeader.
+func (s *Server) messageTTL(hdr string) (time.Duration, error) {
+	if hdr == "" {
+		return s.defaultTTL, nil
+	}
+
+	secs, err := strconv.ParseUint(hdr, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return s.capTTL(secs), nil
+}
+
+// expireMessages drops expired messages from the queues and history of all
+// users.
+func (s *Server) expireMessages() {
+	names, err := s.users.List()
+	if err != nil {
+		log.Printf("unable to list users for expiry: %v", err)
+		return
+	}
+
+	now := time.Now()
+	var total int
+	for _, name := range names {
+		user, err := s.users.Get(name)
+		if err != nil {
+			// Deleted since listing.
+			continue
+		}
+
+		n, err := user.Expire(now)
+		if err != nil {
+			log.Printf("message expiry failed for %s: %v", name, err)
+		}
+		total += n
+	}
+
+	if total > 0 {
+		log.Printf("expired %d messages", total)
+	}
+}
+
+// getStats returns message counts summed over all users. It is only served to
+// admin sessions, as it tells how busy the server is.
+func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
+	names, err := s.users.List()
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to list users: %v", err)
+		return
+	}
+
+	var resp api.ServerStats
+	for _, name := range names {
+		user, err := s.users.Get(name)
+		if err != nil {
+			continue
+		}
+
+		st, err := user.Stats()
+		if err != nil {
+			sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve stats: %v", err)
+			return
+		}
+
+		resp.Users++
+		resp.Queued += st.Queued
+		resp.History += st.History
+		resp.Expired += st.Expired
+		resp.Bytes += st.Bytes
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+func (s *Server) getUserStats(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	st, err := user.Stats()
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve stats: %v", err)
+		return
+	}
+
+	resp := api.Stats(st)
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/kennylevinsen/locshare/api"
+	"github.com/kennylevinsen/locshare/groups"
+	"github.com/kennylevinsen/locshare/sessions"
+)
+
+// notifyGroup sends a group event caused by actor to the named users.
+func (s *Server) notifyGroup(actor string, recipients []string, ev api.GroupEvent) {
+	b, err := json.Marshal(&ev)
+	if err != nil {
+		log.Printf("unable to marshal group event: %v", err)
+		return
+	}
+
+	for _, r := range recipients {
+		user, err := s.users.Get(r)
+		if err != nil {
+			continue
+		}
+
+		if err := user.Notify(actor, b); err != nil {
+			log.Printf("unable to notify %s of group event: %v", r, err)
+		}
+	}
+}
+
+func sessionUsername(r *http.Request) string {
+	sess := r.Context().Value(contextKeySession).(sessions.Session)
+	username, _ := sess.Username()
+	return username
+}
+
+func (s *Server) postGroup(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendBodyError(w, err)
+		return
+	}
+
+	var req api.NewGroupReq
+	if err = json.Unmarshal(b, &req); err != nil {
+		sendError(w, api.CodeInvalidRequest, "could not parse request: %v", err)
+		return
+	}
+
+	if req.Name == "" {
+		sendError(w, api.CodeInvalidRequest, "group name must not be empty")
+		return
+	}
+
+	g, err := s.groups.New(sessionUsername(r), req.Name)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to create group: %v", err)
+		return
+	}
+
+	resp := api.Group(g)
+	b, err = json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+func (s *Server) getGroups(w http.ResponseWriter, r *http.Request) {
+	list, err := s.groups.ForUser(sessionUsername(r))
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to list groups: %v", err)
+		return
+	}
+
+	resp := api.GroupsResp{
+		Groups: make([]api.Group, len(list)),
+	}
+	for idx, g := range list {
+		resp.Groups[idx] = api.Group(g)
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+// visibleGroup retrieves the group named in the request, if the user of the
+// session is a member or invited. Other groups are reported as missing.
+func (s *Server) visibleGroup(w http.ResponseWriter, r *http.Request) (groups.Group, bool) {
+	id := r.Context().Value(contextKeyGroupParam).(string)
+	username := sessionUsername(r)
+	g, err := s.groups.Get(id)
+	if err != nil || (!g.IsMember(username) && !g.IsInvited(username)) {
+		sendError(w, api.CodeNoSuchGroup, "no such group")
+		return groups.Group{}, false
+	}
+
+	return g, true
+}
+
+func (s *Server) getGroup(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.visibleGroup(w, r)
+	if !ok {
+		return
+	}
+
+	resp := api.Group(g)
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+func (s *Server) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.visibleGroup(w, r)
+	if !ok {
+		return
+	}
+
+	username := sessionUsername(r)
+	if g.Owner != username {
+		sendError(w, api.CodeNotOwner, "access denied: %v", groups.ErrNotOwner)
+		return
+	}
+
+	if err := s.groups.Del(g.ID); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to delete group: %v", err)
+		return
+	}
+
+	s.notifyGroup(username, append(g.Members, g.Invited...), api.GroupEvent{Group: g.ID, Event: api.GroupEventDeleted})
+	sendOK(w)
+}
+
+// putMember invites a user to the group if done by the owner, or accepts
+// an invitation if done by the invited user.
+func (s *Server) putMember(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.visibleGroup(w, r)
+	if !ok {
+		return
+	}
+
+	username := sessionUsername(r)
+	member := r.Context().Value(contextKeyMemberParam).(string)
+
+	if member == username {
+		if err := s.groups.Join(g.ID, member); err != nil {
+			sendError(w, errorCode(err, api.CodeInvalidRequest), "unable to join group: %v", err)
+			return
+		}
+
+		s.notifyGroup(username, g.Members, api.GroupEvent{Group: g.ID, Event: api.GroupEventJoined, Member: member})
+		sendOK(w)
+		return
+	}
+
+	if g.Owner != username {
+		sendError(w, api.CodeNotOwner, "access denied: %v", groups.ErrNotOwner)
+		return
+	}
+
+	if _, err := s.users.Get(member); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if err := s.groups.Invite(g.ID, member); err != nil {
+		sendError(w, errorCode(err, api.CodeInvalidRequest), "unable to invite user: %v", err)
+		return
+	}
+
+	s.notifyGroup(username, append(g.Members, member), api.GroupEvent{Group: g.ID, Event: api.GroupEventInvited, Member: member})
+	sendOK(w)
+}
+
+// deleteMember leaves the group or declines an invitation if done by the
+// member, or removes the member if done by the owner.
+func (s *Server) deleteMember(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.visibleGroup(w, r)
+	if !ok {
+		return
+	}
+
+	username := sessionUsername(r)
+	member := r.Context().Value(contextKeyMemberParam).(string)
+	if member != username && g.Owner != username {
+		sendError(w, api.CodeNotOwner, "access denied: %v", groups.ErrNotOwner)
+		return
+	}
+
+	if err := s.groups.Leave(g.ID, member); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to leave group: %v", err)
+		return
+	}
+
+	ev := api.GroupEvent{Group: g.ID, Event: api.GroupEventLeft, Member: member}
+	if member == g.Owner {
+		ev = api.GroupEvent{Group: g.ID, Event: api.GroupEventDeleted}
+	}
+	s.notifyGroup(username, append(g.Members, g.Invited...), ev)
+	sendOK(w)
+}
+
+// putGroupMessage fans a message out to group members. Being a member of the
+// group stands in for the sharing permission of each recipient, but blocks
+// and rate limits still apply.
+func (s *Server) putGroupMessage(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendBodyError(w, err)
+		return
+	}
+
+	var req api.GroupMessageReq
+	if err = json.Unmarshal(b, &req); err != nil {
+		sendError(w, api.CodeInvalidRequest, "could not parse request: %v", err)
+		return
+	}
+
+	g, ok := s.visibleGroup(w, r)
+	if !ok {
+		return
+	}
+
+	source := sessionUsername(r)
+	if !g.IsMember(source) {
+		sendError(w, api.CodeNotMember, "access denied: %v", groups.ErrNotMember)
+		return
+	}
+
+	resp := api.GroupMessageResp{
+		Delivered: []string{},
+		Failed:    make(map[string]string),
+	}
+
+	for recipient, content := range req.Recipients {
+		if !g.IsMember(recipient) {
+			resp.Failed[recipient] = groups.ErrNotMember.Error()
+			continue
+		}
+
+		user, err := s.users.Get(recipient)
+		if err != nil {
+			resp.Failed[recipient] = err.Error()
+			continue
+		}
+
+		if err := user.Publish(source, content, s.capTTL(req.TTL), int(s.limits.Quota)); err != nil {
+			resp.Failed[recipient] = err.Error()
+			continue
+		}
+
+		resp.Delivered = append(resp.Delivered, recipient)
+	}
+	sort.Strings(resp.Delivered)
+
+	b, err = json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/kennylevinsen/locshare/api"
+	"github.com/kennylevinsen/locshare/proto"
+	"github.com/kennylevinsen/locshare/users"
+)
+
+// Limits holds the maximum sizes of request bodies, in bytes. Requests with
+// larger bodies are rejected with api.CodeTooLarge. It also holds the quota
+// on the messages queued for each user.
+type Limits struct {
+	// Auth covers logins, token refreshes, user creation and password
+	// changes.
+	Auth int64
+	// Identity covers identity keys.
+	Identity int64
+	// Key covers temporary and one-time keys.
+	Key int64
+	// Message covers messages to a single user.
+	Message int64
+	// Group covers group creation and group messages, which carry a copy of
+	// the message for every recipient.
+	Group int64
+	// Frame covers frames of the TCP protocol.
+	Frame int64
+
+	// Quota caps the total size of the unacknowledged messages of a user.
+	// Messages that would exceed it are rejected with
+	// api.CodeQuotaExceeded until earlier ones are acknowledged or expire.
+	Quota int64
+}
+
+// DefaultLimits is used for the fields of Config.Limits left zero.
+var DefaultLimits = Limits{
+	Auth:     4 << 10,
+	Identity: 4 << 10,
+	Key:      4 << 10,
+	Message:  64 << 10,
+	Group:    1 << 20,
+	Frame:    proto.DefaultMaxFrameSize,
+	Quota:    users.UserStorageQuota,
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.Auth == 0 {
+		l.Auth = DefaultLimits.Auth
+	}
+	if l.Identity == 0 {
+		l.Identity = DefaultLimits.Identity
+	}
+	if l.Key == 0 {
+		l.Key = DefaultLimits.Key
+	}
+	if l.Message == 0 {
+		l.Message = DefaultLimits.Message
+	}
+	if l.Group == 0 {
+		l.Group = DefaultLimits.Group
+	}
+	if l.Frame == 0 {
+		l.Frame = DefaultLimits.Frame
+	}
+	if l.Quota == 0 {
+		l.Quota = DefaultLimits.Quota
+	}
+	return l
+}
+
+// limitBody makes reads of the request body fail once more than n bytes have
+// been read.
+func limitBody(n int64) func(http.HandlerFunc) http.HandlerFunc {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				sendError(w, api.CodeTooLarge, "request body exceeds %d bytes", n)
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			f(w, r)
+		}
+	}
+}
+
+// sendBodyError reports a failure to read the request body.
+func sendBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		sendError(w, api.CodeTooLarge, "request body exceeds %d bytes", tooLarge.Limit)
+		return
+	}
+
+	sendError(w, api.CodeInvalidRequest, "could not read body: %v", err)
+}
@@ -2,15 +2,22 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/kennylevinsen/locshare/api"
+	"github.com/kennylevinsen/locshare/contacts"
+	"github.com/kennylevinsen/locshare/groups"
 	"github.com/kennylevinsen/locshare/mux"
+	"github.com/kennylevinsen/locshare/prekey"
 	"github.com/kennylevinsen/locshare/sessions"
 	"github.com/kennylevinsen/locshare/users"
 
@@ -19,28 +26,55 @@ import (
 
 const (
 	PermissionDenied = http.StatusUnauthorized
+	Forbidden        = http.StatusForbidden
 	InvalidRequest   = http.StatusBadRequest
 	ProcessingError  = http.StatusInternalServerError
 	NoSuchEntity     = http.StatusNotFound
+	Conflict         = http.StatusConflict
+	RateLimited      = http.StatusTooManyRequests
+	TooLarge         = http.StatusRequestEntityTooLarge
 )
 
+// ReapInterval is how often expired sessions and messages are removed.
+const ReapInterval = time.Minute
+
+// TTLHeader lets publishers set how long a message stays deliverable, in
+// seconds.
+const TTLHeader = api.TTLHeader
+
+// StreamTouchInterval is how often subscriptions mark their session as used
+// while connected, so it does not expire for being idle. It must be shorter
+// than the shortest idle lifetime of the session policy.
+const StreamTouchInterval = 30 * time.Second
+
+// DefaultMaxMessageTTL is used when Config.MaxMessageTTL is zero.
+const DefaultMaxMessageTTL = 24 * time.Hour
+
+// DefaultMessageTTL is used when Config.MessageTTL is zero. It is longer than
+// DefaultMaxMessageTTL, so that messages without a time-to-live wait for
+// devices that stay offline for days.
+const DefaultMessageTTL = 30 * 24 * time.Hour
+
 var (
-	contextKeySession    = "session"
-	contextKeyUserParam  = "user"
-	contextKeyKeyIDParam = "keyid"
+	contextKeySession      = "session"
+	contextKeyUserParam    = "user"
+	contextKeyKeyIDParam   = "keyid"
+	contextKeySessionID    = "sessionid"
+	contextKeySourceParam  = "source"
+	contextKeyContactParam = "contact"
+	contextKeyGroupParam   = "group"
+	contextKeyMemberParam  = "member"
+	contextKeyDeviceParam  = "device"
 )
 
 var upgrader = websocket.Upgrader{}
 
-type errorResp struct {
-	Status string `json:"status"`
-	Error  string `json:"error"`
-}
-
-func sendError(w http.ResponseWriter, code int, format string, v ...interface{}) {
-	log.Printf("error: %s", fmt.Sprintf(format, v...))
-	e := errorResp{
+// sendError sends an api.ErrorResp with the status of code.
+func sendError(w http.ResponseWriter, code api.ErrorCode, format string, v ...interface{}) {
+	log.Printf("error: %s: %s", code, fmt.Sprintf(format, v...))
+	e := api.ErrorResp{
 		Status: "error",
+		Code:   code,
 		Error:  fmt.Sprintf(format, v...),
 	}
 
@@ -49,36 +83,99 @@ func sendError(w http.ResponseWriter, code int, format string, v ...interface{})
 		w.WriteHeader(ProcessingError)
 		return
 	}
-	w.WriteHeader(code)
+	w.WriteHeader(statusOf(code))
 	w.Write(b)
 }
 
+var okResp, _ = json.Marshal(&api.OKResp{Status: "ok"})
+
+// sendOK sends an api.OKResp, for requests with nothing else to return.
+func sendOK(w http.ResponseWriter) {
+	w.Write(okResp)
+}
+
 type Server struct {
 	http.Handler
 	sessions sessions.SessionDB
 	users    users.UserDB
+	contacts contacts.ContactDB
+	groups   groups.GroupDB
+	grants   *sessions.GrantPolicy
+
+	subscribeOpts users.SubscribeOptions
+	maxTTL        time.Duration
+	defaultTTL    time.Duration
+	limits        Limits
+	certUser      func(*x509.Certificate) (string, error)
+	certGrants    *sessions.GrantPolicy
+
+	done chan struct{}
+}
+
+func (s *Server) reaper() {
+	t := time.NewTicker(ReapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+
+		n, err := s.sessions.Reap()
+		if err != nil {
+			log.Printf("session reaping failed: %v", err)
+		}
+		if n > 0 {
+			log.Printf("reaped %d expired sessions", n)
+		}
+
+		s.expireMessages()
+	}
+}
+
+// Close stops the background tasks of the server.
+func (s *Server) Close() error {
+	close(s.done)
+	return nil
 }
 
-func (s *Server) requireValidToken(capability string, f http.HandlerFunc) http.HandlerFunc {
+// requireValidToken only lets requests with a valid session through. If kind
+// is not empty, the session must also hold that capability for the user named
+// in the request, if any.
+func (s *Server) requireValidToken(kind sessions.Kind, f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var token string
 		tokenHdr := r.Header.Get("Authorization")
 		if tokenHdr != "" {
 			tokenParts := strings.Split(tokenHdr, " ")
-			if len(tokenParts) == 2 && tokenParts[0] == "LOCSHARE" {
+			if len(tokenParts) == 2 && tokenParts[0] == api.AuthorizationScheme {
 				token = tokenParts[1]
 			}
 		}
 
 		session, err := s.sessions.Get(token)
+		if err == sessions.ErrSessionExpired {
+			sendError(w, api.CodeSessionExpired, "session expired")
+			return
+		}
 		if err != nil {
-			sendError(w, PermissionDenied, "no such session")
+			sendError(w, api.CodeNoSession, "no such session")
 			return
 		}
 
-		if err := session.HasCapability(capability); err != nil {
-			sendError(w, PermissionDenied, "access denied: %v", err)
-			return
+		if kind != "" {
+			target, _ := r.Context().Value(contextKeyUserParam).(string)
+			if err := session.HasCapability(kind, target); err != nil {
+				sendError(w, api.CodeCapabilityMissing, "access denied: %v", err)
+				return
+			}
+		}
+
+		// Only requests the session may make count as use, so denied
+		// requests cannot keep it alive.
+		if err := session.Touch(); err != nil {
+			log.Printf("unable to record session use: %v", err)
 		}
 
 		ctx := context.WithValue(r.Context(), contextKeySession, session)
@@ -86,146 +183,281 @@ func (s *Server) requireValidToken(capability string, f http.HandlerFunc) http.H
 	}
 }
 
-type authReq struct {
-	Username     string   `json:"username"`
-	Password     string   `json:"password"`
-	Capabilities []string `json:"capabilities"`
+func sendAuthResp(w http.ResponseWriter, session sessions.Session, refreshToken string) {
+	resp := api.AuthResp{
+		Token:        session.Token(),
+		RefreshToken: refreshToken,
+		Expires:      session.Expires(),
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
 }
 
 func (s *Server) auth(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		sendError(w, InvalidRequest, "could not read body: %v", err)
+		sendBodyError(w, err)
 		return
 	}
 
-	var req authReq
+	var req api.AuthReq
 	if err = json.Unmarshal(b, &req); err != nil {
-		sendError(w, InvalidRequest, "could not parse request: %v", err)
+		sendError(w, api.CodeInvalidRequest, "could not parse request: %v", err)
 		return
 	}
 
 	if req.Username == "" || req.Password == "" {
-		sendError(w, InvalidRequest, "username and password must not be empty")
+		sendError(w, api.CodeInvalidRequest, "username and password must not be empty")
 		return
 	}
 
 	if len(req.Capabilities) == 0 {
-		sendError(w, InvalidRequest, "wanted capabilities must be specified")
+		sendError(w, api.CodeInvalidRequest, "wanted capabilities must be specified")
+		return
+	}
+
+	caps, err := sessions.ParseCapabilities(req.Capabilities)
+	if err != nil {
+		sendError(w, api.CodeInvalidCapabilities, "invalid capabilities: %v", err)
+		return
+	}
+
+	if err = s.grants.Check(req.Username, caps, req.Refresh); err != nil {
+		sendError(w, api.CodeCapabilityNotGranted, "access denied: %v", err)
 		return
 	}
 
 	user, err := s.users.Get(req.Username)
 	if err != nil {
-		sendError(w, PermissionDenied, "unable to authenticate")
+		sendError(w, api.CodeAuthFailed, "unable to authenticate")
 		return
 	}
 
 	if err = user.Authenticate(req.Password); err != nil {
-		sendError(w, PermissionDenied, "unable to authenticate")
+		sendError(w, errorCode(err, api.CodeAuthFailed), "unable to authenticate")
+		return
+	}
+
+	s.login(w, req.Username, caps, req.Refresh)
+}
+
+// login creates a session for an authenticated user, and sends its token.
+func (s *Server) login(w http.ResponseWriter, username string, caps []sessions.Capability, refresh bool) {
+	if refresh {
+		session, refreshToken, err := s.sessions.NewRefreshable(username, caps)
+		if err != nil {
+			sendError(w, errorCode(err, api.CodeInternal), "unable to create session: %v", err)
+			return
+		}
+
+		sendAuthResp(w, session, refreshToken)
 		return
 	}
 
-	session, err := s.sessions.New(req.Capabilities)
+	session, err := s.sessions.New(caps)
 	if err != nil {
-		sendError(w, ProcessingError, "unable to create session: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to create session: %v", err)
 		return
 	}
 
-	if err = session.SetUsername(req.Username); err != nil {
-		sendError(w, ProcessingError, "unable to set up session: %v", err)
+	if err = session.SetUsername(username); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to set up session: %v", err)
 		return
 	}
 
-	w.Write([]byte(session.Token()))
+	sendAuthResp(w, session, "")
 }
 
-type postUserReq struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Name     string `json:"name"`
+func (s *Server) refresh(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendBodyError(w, err)
+		return
+	}
+
+	var req api.RefreshReq
+	if err = json.Unmarshal(b, &req); err != nil {
+		sendError(w, api.CodeInvalidRequest, "could not parse request: %v", err)
+		return
+	}
+
+	session, refreshToken, err := s.sessions.Refresh(req.RefreshToken)
+	switch err {
+	case nil:
+	case sessions.ErrRefreshTokenReused:
+		sendError(w, api.CodeRefreshTokenReused, "refresh token reused; all sessions of this login have been revoked")
+		return
+	case sessions.ErrSessionExpired:
+		sendError(w, api.CodeRefreshTokenInvalid, "refresh token expired")
+		return
+	case sessions.ErrNoSuchSession:
+		sendError(w, api.CodeRefreshTokenInvalid, "no such refresh token")
+		return
+	default:
+		sendError(w, errorCode(err, api.CodeInternal), "unable to refresh session: %v", err)
+		return
+	}
+
+	sendAuthResp(w, session, refreshToken)
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	sess := r.Context().Value(contextKeySession).(sessions.Session)
+	if err := s.sessions.DelID(sess.ID()); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to log out: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+func (s *Server) getSessions(w http.ResponseWriter, r *http.Request) {
+	sess := r.Context().Value(contextKeySession).(sessions.Session)
+	username := r.Context().Value(contextKeyUserParam).(string)
+	list, err := s.sessions.List(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to list sessions: %v", err)
+		return
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created().Before(list[j].Created())
+	})
+
+	resp := api.SessionsResp{
+		Sessions: make([]api.Session, len(list)),
+	}
+	for idx, ls := range list {
+		caps := ls.Capabilities()
+		resp.Sessions[idx] = api.Session{
+			ID:           ls.ID(),
+			Capabilities: make([]string, len(caps)),
+			Created:      ls.Created(),
+			LastUsed:     ls.LastUsed(),
+			Current:      ls.ID() == sess.ID(),
+		}
+		for i, c := range caps {
+			resp.Sessions[idx].Capabilities[i] = c.String()
+		}
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+func (s *Server) deleteSession(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	id := r.Context().Value(contextKeySessionID).(string)
+
+	// Sessions of other users are reported as missing, so their IDs cannot
+	// be probed for.
+	target, err := s.sessions.GetID(id)
+	if err != nil {
+		sendError(w, api.CodeNoSuchSession, "no such session")
+		return
+	}
+	if owner, _ := target.Username(); owner != username {
+		sendError(w, api.CodeNoSuchSession, "no such session")
+		return
+	}
+
+	if err := s.sessions.DelID(id); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to revoke session: %v", err)
+		return
+	}
+
+	sendOK(w)
 }
 
 func (s *Server) postUser(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		sendError(w, InvalidRequest, "could not read body: %v", err)
+		sendBodyError(w, err)
 		return
 	}
 
-	var req postUserReq
+	var req api.NewUserReq
 	if err = json.Unmarshal(b, &req); err != nil {
-		sendError(w, InvalidRequest, "could not parse request: %v", err)
+		sendError(w, api.CodeInvalidRequest, "could not parse request: %v", err)
 		return
 	}
 
 	if req.Username == "" || req.Password == "" {
-		sendError(w, InvalidRequest, "username and password must not be empty")
+		sendError(w, api.CodeInvalidRequest, "username and password must not be empty")
 		return
 	}
 
 	if _, err = s.users.New(req.Username, req.Password); err != nil {
-		sendError(w, InvalidRequest, "could not create user: %v", err)
+		sendError(w, errorCode(err, api.CodeInvalidRequest), "could not create user: %v", err)
 		return
 	}
 
-	w.Write([]byte("ok"))
-}
-
-type pastPasswordReq struct {
-	OldPassword string `json:"oldPassword"`
-	NewPassword string `json:"newPassword"`
+	sendOK(w)
 }
 
 func (s *Server) postPassword(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		sendError(w, InvalidRequest, "could not read body: %v", err)
+		sendBodyError(w, err)
 		return
 	}
 
-	var req pastPasswordReq
+	var req api.PasswordReq
 	if err = json.Unmarshal(b, &req); err != nil {
-		sendError(w, InvalidRequest, "could not parse request: %v", err)
+		sendError(w, api.CodeInvalidRequest, "could not parse request: %v", err)
 		return
 	}
 
 	if len(req.NewPassword) == 0 {
-		sendError(w, InvalidRequest, "new password must not be empty")
+		sendError(w, api.CodeInvalidRequest, "new password must not be empty")
 		return
 	}
 
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "parameter not uint: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
 		return
 	}
 
-	if err := user.Authenticate(req.OldPassword); err != nil {
-		sendError(w, InvalidRequest, "invalid password")
+	if err := user.Authenticate(req.OldPassword); err == users.ErrAuthRateLimited {
+		sendError(w, api.CodeAuthRateLimited, "%v", err)
+		return
+	} else if err != nil {
+		sendError(w, api.CodeInvalidRequest, "invalid password")
 		return
 	}
 
 	if err := user.SetPassword(req.NewPassword); err != nil {
-		sendError(w, ProcessingError, "unable to set password")
+		sendError(w, api.CodeInternal, "unable to set password")
 		return
 	}
 
-	w.Write([]byte("ok"))
+	sendOK(w)
 }
 
 func (s *Server) getIdentity(w http.ResponseWriter, r *http.Request) {
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "parameter not uint: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
 		return
 	}
 
 	identity, err := user.Identity()
 	if err != nil {
-		sendError(w, ProcessingError, "unable to retrieve identity: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve identity: %v", err)
 		return
 	}
 
@@ -235,52 +467,53 @@ func (s *Server) getIdentity(w http.ResponseWriter, r *http.Request) {
 func (s *Server) putIdentity(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		sendError(w, InvalidRequest, "could not read body: %v", err)
+		sendBodyError(w, err)
 		return
 	}
 
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "parameter not uint: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
 		return
 	}
 
-	if err := user.SetIdentity(b); err != nil {
-		sendError(w, ProcessingError, "unable to set identity: %v", err)
+	if err := prekey.CheckIdentity(b); err != nil {
+		sendError(w, api.CodeInvalidIdentityKey, "invalid identity key: %v", err)
 		return
 	}
 
-	w.Write([]byte("ok"))
-}
+	if err := user.SetIdentity(b); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to set identity: %v", err)
+		return
+	}
 
-type getTemporaryKeyResp struct {
-	KeyID uint64 `json:"keyID"`
-	Key   []byte `json:"key"`
+	sendOK(w)
 }
 
 func (s *Server) getTemporaryKey(w http.ResponseWriter, r *http.Request) {
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "parameter not uint: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
 		return
 	}
 
-	keyID, key, err := user.TemporaryKey()
+	keyID, key, signature, err := user.TemporaryKey()
 	if err != nil {
-		sendError(w, ProcessingError, "unable to retrieve signed key: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve signed key: %v", err)
 		return
 	}
 
-	resp := getTemporaryKeyResp{
-		KeyID: keyID,
-		Key:   key,
+	resp := api.KeyResp{
+		KeyID:     keyID,
+		Key:       key,
+		Signature: signature,
 	}
 
 	b, err := json.Marshal(&resp)
 	if err != nil {
-		sendError(w, ProcessingError, "unable to marshal response: %v", err)
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
 		return
 	}
 
@@ -290,139 +523,154 @@ func (s *Server) getTemporaryKey(w http.ResponseWriter, r *http.Request) {
 func (s *Server) putTemporaryKey(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		sendError(w, InvalidRequest, "could not read body: %v", err)
+		sendBodyError(w, err)
 		return
 	}
 
 	keyID, err := strconv.ParseUint(r.Context().Value(contextKeyKeyIDParam).(string), 10, 64)
 	if err != nil {
-		sendError(w, NoSuchEntity, "parameter not uint: %v", err)
+		sendError(w, api.CodeInvalidRequest, "key ID not uint: %v", err)
+		return
+	}
+
+	var req api.TemporaryKeyReq
+	if err = json.Unmarshal(b, &req); err != nil {
+		sendError(w, api.CodeInvalidRequest, "could not parse request: %v", err)
+		return
+	}
+
+	if len(req.Key) == 0 {
+		sendError(w, api.CodeInvalidRequest, "key must not be empty")
 		return
 	}
 
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "unable to retrieve user: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	// The key is only accepted if signed by the identity key, so fetchers
+	// can trust it as much as they trust the identity.
+	identity, err := user.Identity()
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve identity: %v", err)
 		return
 	}
 
-	if err := user.SetTemporaryKey(keyID, b); err != nil {
-		sendError(w, ProcessingError, "unable to set signed key: %v", err)
+	if err := prekey.Verify(identity, req.Key, req.Signature); err != nil {
+		sendError(w, errorCode(err, api.CodeInvalidSignature), "unable to verify signed key: %v", err)
 		return
 	}
 
-	w.Write([]byte("ok"))
+	if err := user.SetTemporaryKey(keyID, req.Key, req.Signature); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to set signed key: %v", err)
+		return
+	}
+
+	sendOK(w)
 }
 
 func (s *Server) putOneTimeKey(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		sendError(w, InvalidRequest, "could not read body: %v", err)
+		sendBodyError(w, err)
 		return
 	}
 
 	keyID, err := strconv.ParseUint(r.Context().Value(contextKeyKeyIDParam).(string), 10, 64)
 	if err != nil {
-		sendError(w, NoSuchEntity, "parameter not uint: %v", err)
+		sendError(w, api.CodeInvalidRequest, "key ID not uint: %v", err)
 		return
 	}
 
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "unable to retrieve user: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
 		return
 	}
 
 	if err := user.SetOneTimeKey(keyID, b); err != nil {
-		sendError(w, ProcessingError, "unable to set key: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to set key: %v", err)
 		return
 	}
 
-	w.Write([]byte("ok"))
+	sendOK(w)
 }
 
 func (s *Server) deleteOneTimeKey(w http.ResponseWriter, r *http.Request) {
 	keyID, err := strconv.ParseUint(r.Context().Value(contextKeyKeyIDParam).(string), 10, 64)
 	if err != nil {
-		sendError(w, NoSuchEntity, "parameter not uint: %v", err)
+		sendError(w, api.CodeInvalidRequest, "key ID not uint: %v", err)
 		return
 	}
 
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "unable to retrieve user: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
 		return
 	}
 
 	if err := user.RemoveOneTimeKey(keyID); err != nil {
-		sendError(w, ProcessingError, "unable to delete key: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to delete key: %v", err)
 		return
 	}
 
-	w.Write([]byte("ok"))
-}
-
-type getOneTimeKeysResp struct {
-	Keys []uint64 `json:"keys"`
+	sendOK(w)
 }
 
 func (s *Server) getOneTimeKeys(w http.ResponseWriter, r *http.Request) {
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "unable to retrieve user: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
 		return
 	}
 
 	keys, err := user.OneTimeKeys()
 	if err != nil {
-		sendError(w, ProcessingError, "unable to retrieve keys: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve keys: %v", err)
 		return
 	}
 
-	resp := getOneTimeKeysResp{
+	resp := api.OneTimeKeysResp{
 		Keys: keys,
 	}
 
 	b, err := json.Marshal(&resp)
 	if err != nil {
-		sendError(w, ProcessingError, "unable to marshal response: %v", err)
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
 		return
 	}
 
 	w.Write(b)
 }
 
-type getOneTimeKeyResp struct {
-	KeyID uint64 `json:"keyID"`
-	Key   []byte `json:"key"`
-}
-
 func (s *Server) getOneTimeKey(w http.ResponseWriter, r *http.Request) {
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "unable to retrieve user: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
 		return
 	}
 
 	keyID, key, err := user.PopOneTimeKey()
 	if err != nil {
-		sendError(w, ProcessingError, "unable to retrieve one time key: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve one time key: %v", err)
 		return
 	}
 
-	resp := getOneTimeKeyResp{
+	resp := api.KeyResp{
 		KeyID: keyID,
 		Key:   key,
 	}
 
 	b, err := json.Marshal(&resp)
 	if err != nil {
-		sendError(w, ProcessingError, "unable to marshal response: %v", err)
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
 		return
 	}
 
@@ -432,69 +680,527 @@ func (s *Server) getOneTimeKey(w http.ResponseWriter, r *http.Request) {
 func (s *Server) putMessage(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		sendError(w, InvalidRequest, "could not read body: %v", err)
+		sendBodyError(w, err)
 		return
 	}
 
 	sess := r.Context().Value(contextKeySession).(sessions.Session)
 	source, err := sess.Username()
 	if err != nil {
-		sendError(w, ProcessingError, "unable to retrieve username from session: %v", err)
+		sendError(w, api.CodeInternal, "unable to retrieve username from session: %v", err)
+		return
+	}
+
+	ttl, err := s.messageTTL(r.Header.Get(TTLHeader))
+	if err != nil {
+		sendError(w, api.CodeInvalidRequest, "invalid ttl: %v", err)
 		return
 	}
 
 	username := r.Context().Value(contextKeyUserParam).(string)
 	user, err := s.users.Get(username)
 	if err != nil {
-		sendError(w, NoSuchEntity, "unable to retrieve user: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if !accepts(user, source) {
+		sendError(w, api.CodeSharingNotAllowed, "%s does not accept locations from %s", username, source)
 		return
 	}
 
 	log.Printf("%s -> %v", source, b)
 
-	if err := user.Publish(source, b); err != nil {
-		sendError(w, ProcessingError, "publish failed: %v", err)
+	switch err := user.Publish(source, b, ttl, int(s.limits.Quota)); err {
+	case nil:
+	case users.ErrBlocked:
+		sendError(w, api.CodeSharingNotAllowed, "%s does not accept locations from %s", username, source)
+		return
+	default:
+		sendError(w, errorCode(err, api.CodeInternal), "publish failed: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+// accepts reports whether user takes messages from source. Blocks and sharing
+// permissions are only kept by the user, and every front end checks them here.
+func accepts(user users.User, source string) bool {
+	return !user.IsBlocked(source) && user.SharingAllowed(source)
+}
+
+func (s *Server) postSharing(w http.ResponseWriter, r *http.Request) {
+	sess := r.Context().Value(contextKeySession).(sessions.Session)
+	source, err := sess.Username()
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to retrieve username from session: %v", err)
+		return
+	}
+
+	username := r.Context().Value(contextKeyUserParam).(string)
+	if username == source {
+		sendError(w, api.CodeInvalidRequest, "cannot request sharing with self")
+		return
+	}
+
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if err := user.RequestSharing(source); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to request sharing: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+func sharingSources(sharing map[string]users.SharingState, state users.SharingState) []string {
+	list := []string{}
+	for k, v := range sharing {
+		if v == state {
+			list = append(list, k)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (s *Server) getSharing(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	sharing, err := user.Sharing()
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve sharing: %v", err)
+		return
+	}
+
+	resp := api.SharingResp{
+		Accepted: sharingSources(sharing, users.SharingAccepted),
+		Pending:  sharingSources(sharing, users.SharingPending),
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+func (s *Server) putSharing(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	source := r.Context().Value(contextKeySourceParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if err := user.AcceptSharing(source); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to accept sharing: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+// deleteSharing rejects or revokes sharing. It can be used by either the
+// recipient or the source.
+func (s *Server) deleteSharing(w http.ResponseWriter, r *http.Request) {
+	sess := r.Context().Value(contextKeySession).(sessions.Session)
+	self, err := sess.Username()
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to retrieve username from session: %v", err)
+		return
+	}
+
+	username := r.Context().Value(contextKeyUserParam).(string)
+	source := r.Context().Value(contextKeySourceParam).(string)
+	if self != username && self != source {
+		sendError(w, api.CodeAccessDenied, "access denied")
+		return
+	}
+
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if err := user.RemoveSharing(source); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to remove sharing: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+func (s *Server) getContacts(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	list, err := s.contacts.List(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to list contacts: %v", err)
+		return
+	}
+
+	resp := api.ContactsResp{
+		Contacts: make([]api.Contact, len(list)),
+	}
+	for idx, c := range list {
+		resp.Contacts[idx] = api.Contact{
+			Username: c.Username,
+			State:    string(c.State),
+			Incoming: c.Incoming,
+			CanSee:   user.SharingAllowed(c.Username),
+		}
+		if other, err := s.users.Get(c.Username); err == nil {
+			resp.Contacts[idx].CanSeeMe = other.SharingAllowed(username)
+		}
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+func (s *Server) postContact(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	other := r.Context().Value(contextKeyContactParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	target, err := s.users.Get(other)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if user.IsBlocked(other) {
+		sendError(w, api.CodeInvalidRequest, "%s is blocked; unblock them first", other)
+		return
+	}
+
+	if err := s.contacts.Request(username, other, target.IsBlocked(username)); err != nil {
+		sendError(w, errorCode(err, api.CodeInvalidRequest), "unable to request contact: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+func (s *Server) putContact(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	other := r.Context().Value(contextKeyContactParam).(string)
+	if err := s.contacts.Accept(username, other); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to accept contact: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+func (s *Server) deleteContact(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	other := r.Context().Value(contextKeyContactParam).(string)
+	if err := s.contacts.Remove(username, other); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to remove contact: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+func (s *Server) getBlocks(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	blocked, err := user.Blocked()
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve blocked users: %v", err)
+		return
+	}
+
+	resp := api.BlocksResp{
+		Blocked: blocked,
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+func (s *Server) putBlock(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	other := r.Context().Value(contextKeyContactParam).(string)
+	if username == other {
+		sendError(w, api.CodeInvalidRequest, "cannot block self")
+		return
+	}
+
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if err := user.Block(other); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to block user: %v", err)
+		return
+	}
+
+	// The block itself is kept by the user; any contact simply ends.
+	if err := s.contacts.Remove(username, other); err != nil && err != contacts.ErrNoSuchContact {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to remove contact: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+func (s *Server) deleteBlock(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	other := r.Context().Value(contextKeyContactParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if err := user.Unblock(other); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to unblock user: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+func (s *Server) getDevices(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	devices, err := user.Devices()
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve devices: %v", err)
+		return
+	}
+
+	resp := api.DevicesResp{
+		Devices: make([]api.Device, len(devices)),
+	}
+	for idx, d := range devices {
+		resp.Devices[idx] = api.Device(d)
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+// putDevice registers a device, and binds the current session to it.
+func (s *Server) putDevice(w http.ResponseWriter, r *http.Request) {
+	sess := r.Context().Value(contextKeySession).(sessions.Session)
+	username := r.Context().Value(contextKeyUserParam).(string)
+	device := r.Context().Value(contextKeyDeviceParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if err := user.RegisterDevice(device); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to register device: %v", err)
+		return
+	}
+
+	if err := sess.SetDevice(device); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to bind session to device: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
+
+func (s *Server) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value(contextKeyUserParam).(string)
+	device := r.Context().Value(contextKeyDeviceParam).(string)
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
 		return
 	}
 
-	w.Write([]byte("ok"))
+	if err := user.RemoveDevice(device); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to remove device: %v", err)
+		return
+	}
+
+	sendOK(w)
 }
 
 func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
 	username := r.Context().Value(contextKeyUserParam).(string)
+
+	// Sessions go first, as tokens of the user must not act on an account
+	// later registered under the same name.
+	if err := s.sessions.DelUser(username); err != nil {
+		sendError(w, api.CodeInternal, "unable to revoke sessions: %v", err)
+		return
+	}
+
 	if err := s.users.Del(username); err != nil {
-		sendError(w, ProcessingError, "unable to delete user")
+		sendError(w, api.CodeInternal, "unable to delete user")
 		return
 	}
 
-	w.Write([]byte("ok"))
+	if err := s.contacts.DelUser(username); err != nil {
+		log.Printf("unable to delete contacts of %s: %v", username, err)
+	}
+
+	if err := s.groups.DelUser(username); err != nil {
+		log.Printf("unable to delete group memberships of %s: %v", username, err)
+	}
+
+	sendOK(w)
 }
 
-type subscribeResp struct {
-	Source  string `json:"source"`
-	Content []byte `json:"content"`
+// subscriber is a subscription opened for the session of a request.
+type subscriber struct {
+	sess   sessions.Session
+	user   users.User
+	device string
+	ch     <-chan users.UserMessage
 }
 
-func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
+// openSubscription subscribes the device of the session of the request. The
+// "overflow" query parameter selects the overflow policy, and the "since"
+// query parameter, or a Last-Event-ID header, the cursor to resume from. On
+// failure, an error is sent and nil returned.
+func (s *Server) openSubscription(w http.ResponseWriter, r *http.Request) *subscriber {
 	sess := r.Context().Value(contextKeySession).(sessions.Session)
 	source, err := sess.Username()
 	if err != nil {
-		sendError(w, ProcessingError, "unable to retrieve username from session: %v", err)
-		return
+		sendError(w, api.CodeInternal, "unable to retrieve username from session: %v", err)
+		return nil
 	}
 
 	user, err := s.users.Get(source)
 	if err != nil {
-		sendError(w, NoSuchEntity, "unable to retrieve user: %v", err)
-		return
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return nil
+	}
+
+	opts := s.subscribeOpts
+	if o := r.URL.Query().Get("overflow"); o != "" {
+		if opts.Overflow, err = users.ParseOverflowPolicy(o); err != nil {
+			sendError(w, api.CodeInvalidRequest, "invalid overflow policy: %v", err)
+			return nil
+		}
+	}
+
+	sc := r.URL.Query().Get("since")
+	if sc == "" {
+		sc = r.Header.Get("Last-Event-ID")
+	}
+	var since uint64
+	if sc != "" {
+		if since, err = strconv.ParseUint(sc, 10, 64); err != nil {
+			sendError(w, api.CodeInvalidRequest, "since not uint: %v", err)
+			return nil
+		}
 	}
 
-	ch, err := user.Subscribe()
+	device := sess.Device()
+	ch, err := user.Subscribe(device, opts, since)
 	if err != nil {
-		sendError(w, ProcessingError, "unable to subscribe: %v", err)
+		sendError(w, errorCode(err, api.CodeInternal), "unable to subscribe: %v", err)
+		return nil
+	}
+
+	return &subscriber{sess, user, device, ch}
+}
+
+func (sub *subscriber) close() {
+	sub.user.Unsubscribe(sub.ch)
+}
+
+// touch marks the session of the subscription as used.
+func (sub *subscriber) touch() {
+	if err := sub.sess.Touch(); err != nil {
+		log.Printf("unable to record session use: %v", err)
+	}
+}
+
+// deliverable reports whether msg should be sent to the subscriber. Messages
+// that should not are acknowledged, so they are not delivered again.
+func (sub *subscriber) deliverable(msg users.UserMessage) bool {
+	if sub.user.IsBlocked(msg.Source()) {
+		sub.user.Ack(sub.device, msg.Seq())
+		return false
+	}
+
+	// The message may have expired while waiting in the subscription.
+	if exp := msg.Expires(); !exp.IsZero() && time.Now().After(exp) {
+		sub.user.Ack(sub.device, msg.Seq())
+		return false
+	}
+
+	return true
+}
+
+func newSubscribeResp(msg users.UserMessage) api.Message {
+	return api.Message{
+		Seq:     msg.Seq(),
+		Kind:    msg.Kind(),
+		Source:  msg.Source(),
+		Content: msg.Content(),
+	}
+}
+
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
+	sub := s.openSubscription(w, r)
+	if sub == nil {
 		return
 	}
-	defer user.Unsubscribe(ch)
+	defer sub.close()
 
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -504,12 +1210,48 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 
 	defer c.Close()
 
-	for msg := range ch {
-		if !sess.IsValid() {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var req api.AckReq
+			if err := c.ReadJSON(&req); err != nil {
+				return
+			}
+
+			if len(req.Ack) > 0 {
+				if err := sub.user.Ack(sub.device, req.Ack...); err != nil {
+					log.Printf("unable to acknowledge messages: %v", err)
+				}
+			}
+		}
+	}()
+
+	touch := time.NewTicker(StreamTouchInterval)
+	defer touch.Stop()
+
+	for {
+		var msg users.UserMessage
+		select {
+		case <-sub.sess.Done():
+			return
+		case <-closed:
+			return
+		case <-touch.C:
+			sub.touch()
+			continue
+		case msg = <-sub.ch:
+		}
+
+		if msg == nil || !sub.sess.IsValid() {
 			return
 		}
 
-		jsonMsg := subscribeResp{msg.Source(), msg.Content()}
+		if !sub.deliverable(msg) {
+			continue
+		}
+
+		jsonMsg := newSubscribeResp(msg)
 		if err := c.WriteJSON(&jsonMsg); err != nil {
 			return
 		}
@@ -521,13 +1263,13 @@ func paramIsSelf(f http.HandlerFunc) http.HandlerFunc {
 		sess := r.Context().Value(contextKeySession).(sessions.Session)
 		username, err := sess.Username()
 		if err != nil {
-			sendError(w, ProcessingError, "unable to retrieve username from session: %v", err)
+			sendError(w, api.CodeInternal, "unable to retrieve username from session: %v", err)
 			return
 		}
 
 		userParam := r.Context().Value(contextKeyUserParam).(string)
 		if username != userParam {
-			sendError(w, PermissionDenied, "access denied")
+			sendError(w, api.CodeAccessDenied, "access denied")
 			return
 		}
 
@@ -537,13 +1279,19 @@ func paramIsSelf(f http.HandlerFunc) http.HandlerFunc {
 
 func (s *Server) setupMux() {
 	interactive := func(h http.HandlerFunc) http.HandlerFunc {
-		return s.requireValidToken("interactive", h)
+		return s.requireValidToken(sessions.Interactive, h)
 	}
 	publish := func(h http.HandlerFunc) http.HandlerFunc {
-		return s.requireValidToken("publish", h)
+		return s.requireValidToken(sessions.Publish, h)
 	}
 	destroyer := func(h http.HandlerFunc) http.HandlerFunc {
-		return s.requireValidToken("destroyer", h)
+		return s.requireValidToken(sessions.Destroyer, h)
+	}
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return s.requireValidToken(sessions.Admin, h)
+	}
+	authenticated := func(h http.HandlerFunc) http.HandlerFunc {
+		return s.requireValidToken("", h)
 	}
 	w := func(f http.HandlerFunc, h ...func(http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
 		for idx := len(h) - 1; idx >= 0; idx-- {
@@ -552,51 +1300,192 @@ func (s *Server) setupMux() {
 
 		return f
 	}
+	limits := s.limits
 	param := mux.NewParam
 	method := mux.NewMethod
 	s.Handler = mux.New().
-		Handle("/auth", method().
-			MethodFunc("POST", s.auth)).
-		Handle("/user", param(contextKeyUserParam).
+		Handle(api.AuthRoute, mux.New().
+			Handle(api.AuthRefresh, method().
+				MethodFunc("POST", w(s.refresh, limitBody(limits.Auth)))).
+			Handle(api.AuthCert, method().
+				MethodFunc("POST", w(s.authCert, limitBody(limits.Auth)))).
+			Handle(api.Root, method().
+				MethodFunc("POST", w(s.auth, limitBody(limits.Auth))).
+				MethodFunc("DELETE", w(s.logout, authenticated)))).
+		Handle(api.UserRoute, param(contextKeyUserParam).
 			Param(mux.New().
-				Handle("/password", method().
-					MethodFunc("POST", w(s.postPassword, interactive, paramIsSelf))).
-				Handle("/identity", method().
+				Handle(api.UserPassword, method().
+					MethodFunc("POST", w(s.postPassword, limitBody(limits.Auth), interactive, paramIsSelf))).
+				Handle(api.UserIdentity, method().
 					MethodFunc("GET", w(s.getIdentity, interactive)).
-					MethodFunc("PUT", w(s.putIdentity, interactive, paramIsSelf))).
-				Handle("/temporaryKey", param(contextKeyKeyIDParam).
+					MethodFunc("PUT", w(s.putIdentity, limitBody(limits.Identity), interactive, paramIsSelf))).
+				Handle(api.UserTemporaryKey, param(contextKeyKeyIDParam).
 					Param(method().
-						MethodFunc("PUT", w(s.putTemporaryKey, interactive, paramIsSelf))).
+						MethodFunc("PUT", w(s.putTemporaryKey, limitBody(limits.Key), interactive, paramIsSelf))).
 					NoParam(method().
 						MethodFunc("GET", w(s.getTemporaryKey, interactive)))).
-				Handle("/oneTimeKey", param(contextKeyKeyIDParam).
+				Handle(api.UserOneTimeKey, param(contextKeyKeyIDParam).
 					Param(method().
-						MethodFunc("PUT", w(s.putOneTimeKey, interactive, paramIsSelf)).
+						MethodFunc("PUT", w(s.putOneTimeKey, limitBody(limits.Key), interactive, paramIsSelf)).
 						MethodFunc("DELETE", w(s.deleteOneTimeKey, interactive, paramIsSelf))).
 					NoParam(method().
 						MethodFunc("GET", w(s.getOneTimeKey, interactive)))).
-				Handle("/oneTimekeys", method().
+				Handle(api.UserOneTimeKeys, method().
 					MethodFunc("GET", w(s.getOneTimeKeys, interactive, paramIsSelf))).
-				Handle("/message", method().
-					MethodFunc("PUT", w(s.putMessage, publish))).
-				Handle("/", method().
+				Handle(api.UserMessage, method().
+					MethodFunc("PUT", w(s.putMessage, limitBody(limits.Message), publish))).
+				Handle(api.UserSharing, param(contextKeySourceParam).
+					Param(method().
+						MethodFunc("PUT", w(s.putSharing, interactive, paramIsSelf)).
+						MethodFunc("DELETE", w(s.deleteSharing, interactive))).
+					NoParam(method().
+						MethodFunc("GET", w(s.getSharing, interactive, paramIsSelf)).
+						MethodFunc("POST", w(s.postSharing, interactive)))).
+				Handle(api.UserContacts, param(contextKeyContactParam).
+					Param(method().
+						MethodFunc("POST", w(s.postContact, interactive, paramIsSelf)).
+						MethodFunc("PUT", w(s.putContact, interactive, paramIsSelf)).
+						MethodFunc("DELETE", w(s.deleteContact, interactive, paramIsSelf))).
+					NoParam(method().
+						MethodFunc("GET", w(s.getContacts, interactive, paramIsSelf)))).
+				Handle(api.UserBlocks, param(contextKeyContactParam).
+					Param(method().
+						MethodFunc("PUT", w(s.putBlock, interactive, paramIsSelf)).
+						MethodFunc("DELETE", w(s.deleteBlock, interactive, paramIsSelf))).
+					NoParam(method().
+						MethodFunc("GET", w(s.getBlocks, interactive, paramIsSelf)))).
+				Handle(api.UserDevices, param(contextKeyDeviceParam).
+					Param(method().
+						MethodFunc("PUT", w(s.putDevice, interactive, paramIsSelf)).
+						MethodFunc("DELETE", w(s.deleteDevice, interactive, paramIsSelf))).
+					NoParam(method().
+						MethodFunc("GET", w(s.getDevices, interactive, paramIsSelf)))).
+				Handle(api.UserStats, method().
+					MethodFunc("GET", w(s.getUserStats, interactive, paramIsSelf))).
+				Handle(api.UserSessions, param(contextKeySessionID).
+					Param(method().
+						MethodFunc("DELETE", w(s.deleteSession, interactive, paramIsSelf))).
+					NoParam(method().
+						MethodFunc("GET", w(s.getSessions, interactive, paramIsSelf)))).
+				Handle(api.Root, method().
 					MethodFunc("DELETE", w(s.deleteUser, destroyer, paramIsSelf)))).
 			NoParam(method().
-				MethodFunc("POST", s.postUser))).
-		Handle("/ws", mux.New().
-			Handle("/subscribe", w(s.subscribe, interactive))).
+				MethodFunc("POST", w(s.postUser, limitBody(limits.Auth))))).
+		Handle(api.GroupRoute, param(contextKeyGroupParam).
+			Param(mux.New().
+				Handle(api.GroupMember, param(contextKeyMemberParam).
+					Param(method().
+						MethodFunc("PUT", w(s.putMember, interactive)).
+						MethodFunc("DELETE", w(s.deleteMember, interactive)))).
+				Handle(api.GroupMessage, method().
+					MethodFunc("PUT", w(s.putGroupMessage, limitBody(limits.Group), publish))).
+				Handle(api.Root, method().
+					MethodFunc("GET", w(s.getGroup, interactive)).
+					MethodFunc("DELETE", w(s.deleteGroup, interactive)))).
+			NoParam(method().
+				MethodFunc("GET", w(s.getGroups, interactive)).
+				MethodFunc("POST", w(s.postGroup, limitBody(limits.Group), interactive)))).
+		Handle(api.StatsRoute, method().
+			MethodFunc("GET", w(s.getStats, admin))).
+		Handle(api.WSRoute, mux.New().
+			Handle(api.SubscribeRoute, w(s.subscribe, interactive))).
+		Handle(api.SSERoute, mux.New().
+			Handle(api.SubscribeRoute, w(s.sseSubscribe, interactive))).
+		Handle(api.PollRoute, mux.New().
+			Handle(api.SubscribeRoute, w(s.pollSubscribe, interactive))).
+		Handle(api.AckRoute, method().
+			MethodFunc("POST", w(s.postAck, limitBody(limits.Message), interactive))).
 		Otherwise(http.FileServer(http.Dir(".")))
 
 	s.Handler = mux.NewLogger(s.Handler)
 }
 
-func NewServer() *Server {
+// Config selects the backends used by a Server. Backends left nil are
+// replaced by in-memory implementations.
+type Config struct {
+	Users    users.UserDB
+	Sessions sessions.SessionDB
+	Contacts contacts.ContactDB
+	Groups   groups.GroupDB
+
+	// Grants limits the capabilities logins may obtain. If nil,
+	// sessions.DefaultGrantPolicy is used.
+	Grants *sessions.GrantPolicy
+
+	// CertGrants limits the capabilities client certificate logins may
+	// obtain. If nil, sessions.CertGrantPolicy is used.
+	CertGrants *sessions.GrantPolicy
+
+	// Subscribe sets the queue limit and default overflow policy of
+	// subscriptions. Subscribers may pick another overflow policy with the
+	// "overflow" query parameter. Zero values are replaced by those of
+	// users.DefaultSubscribeOptions.
+	Subscribe users.SubscribeOptions
+
+	// MaxMessageTTL caps the time-to-live publishers may set on messages.
+	// If zero, DefaultMaxMessageTTL is used.
+	MaxMessageTTL time.Duration
+
+	// MessageTTL is the time-to-live of messages published without one.
+	// It is not capped by MaxMessageTTL. If zero, DefaultMessageTTL is used.
+	MessageTTL time.Duration
+
+	// Limits caps the size of request bodies and queued messages. Zero
+	// fields are replaced by those of DefaultLimits.
+	Limits Limits
+
+	// CertUser maps verified client certificates to the user they log in
+	// as. If nil, CommonNameUser is used.
+	CertUser func(*x509.Certificate) (string, error)
+}
+
+func NewServer(cfg Config) *Server {
 	s := Server{
-		sessions: sessions.NewDB(),
-		users:    users.NewDB(),
+		sessions: cfg.Sessions,
+		users:    cfg.Users,
+		contacts: cfg.Contacts,
+		groups:   cfg.Groups,
+		grants:   cfg.Grants,
+
+		subscribeOpts: cfg.Subscribe,
+		maxTTL:        cfg.MaxMessageTTL,
+		defaultTTL:    cfg.MessageTTL,
+		limits:        cfg.Limits.withDefaults(),
+		certUser:      cfg.CertUser,
+		certGrants:    cfg.CertGrants,
+		done:          make(chan struct{}),
+	}
+
+	if s.sessions == nil {
+		s.sessions = sessions.NewDB(sessions.DefaultPolicy)
+	}
+	if s.users == nil {
+		s.users = users.NewDB()
+	}
+	if s.contacts == nil {
+		s.contacts = contacts.NewDB()
+	}
+	if s.groups == nil {
+		s.groups = groups.NewDB()
+	}
+	if s.grants == nil {
+		s.grants = &sessions.DefaultGrantPolicy
+	}
+	if s.certGrants == nil {
+		s.certGrants = &sessions.CertGrantPolicy
+	}
+	if s.certUser == nil {
+		s.certUser = CommonNameUser
+	}
+	if s.maxTTL == 0 {
+		s.maxTTL = DefaultMaxMessageTTL
+	}
+	if s.defaultTTL == 0 {
+		s.defaultTTL = DefaultMessageTTL
 	}
 
 	s.setupMux()
+	go s.reaper()
 
 	return &s
 }
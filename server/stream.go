@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kennylevinsen/locshare/api"
+	"github.com/kennylevinsen/locshare/sessions"
+	"github.com/kennylevinsen/locshare/users"
+)
+
+const (
+	// SSEKeepalive is how often an idle event stream gets a comment, so
+	// proxies do not consider it dead.
+	SSEKeepalive = 30 * time.Second
+
+	// PollTimeout is how long a long-poll waits for messages, unless the
+	// request asks for less with the "timeout" query parameter.
+	PollTimeout = 30 * time.Second
+
+	// pollBatchWait is how long a long-poll that has received a message
+	// waits for more before responding, so queued messages are returned in
+	// one response.
+	pollBatchWait = 50 * time.Millisecond
+
+	// pollBatchLimit is the most messages returned by one long-poll.
+	pollBatchLimit = 256
+)
+
+// sseSubscribe delivers messages as a text/event-stream. Every message is sent
+// as a JSON subscribeResp in the data field, with its sequence number as the
+// event ID, so reconnecting EventSource clients resume where they left off.
+// Messages are acknowledged with postAck.
+func (s *Server) sseSubscribe(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, api.CodeInternal, "streaming not supported")
+		return
+	}
+
+	sub := s.openSubscription(w, r)
+	if sub == nil {
+		return
+	}
+	defer sub.close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SSEKeepalive)
+	defer keepalive.Stop()
+	touch := time.NewTicker(StreamTouchInterval)
+	defer touch.Stop()
+
+	for {
+		var msg users.UserMessage
+		select {
+		case <-sub.sess.Done():
+			return
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			continue
+		case <-touch.C:
+			sub.touch()
+			continue
+		case msg = <-sub.ch:
+		}
+
+		if msg == nil || !sub.sess.IsValid() {
+			return
+		}
+
+		if !sub.deliverable(msg) {
+			continue
+		}
+
+		b, err := json.Marshal(newSubscribeResp(msg))
+		if err != nil {
+			log.Printf("unable to marshal message: %v", err)
+			return
+		}
+
+		// Gap messages have no sequence number, and must not move the
+		// cursor of the client.
+		if msg.Seq() != 0 {
+			fmt.Fprintf(w, "id: %d\n", msg.Seq())
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// pollSubscribe waits until messages are available or the poll times out, and
+// returns them. Clients pass the last sequence number they received as
+// "since" on the next poll, which acknowledges everything up to it.
+func (s *Server) pollSubscribe(w http.ResponseWriter, r *http.Request) {
+	timeout := PollTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		secs, err := strconv.ParseUint(t, 10, 64)
+		if err != nil {
+			sendError(w, api.CodeInvalidRequest, "timeout not uint: %v", err)
+			return
+		}
+		if d := time.Duration(secs) * time.Second; d < timeout {
+			timeout = d
+		}
+	}
+
+	sub := s.openSubscription(w, r)
+	if sub == nil {
+		return
+	}
+	defer sub.close()
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	resp := api.PollResp{
+		Messages: []api.Message{},
+	}
+
+poll:
+	for len(resp.Messages) < pollBatchLimit {
+		var msg users.UserMessage
+		select {
+		case <-sub.sess.Done():
+			break poll
+		case <-ctx.Done():
+			break poll
+		case msg = <-sub.ch:
+		}
+
+		if msg == nil || !sub.sess.IsValid() {
+			break
+		}
+
+		if !sub.deliverable(msg) {
+			continue
+		}
+
+		resp.Messages = append(resp.Messages, newSubscribeResp(msg))
+		if len(resp.Messages) == 1 {
+			ctx, cancel = context.WithTimeout(r.Context(), pollBatchWait)
+			defer cancel()
+		}
+	}
+
+	if !sub.sess.IsValid() {
+		sendError(w, api.CodeSessionExpired, "session expired")
+		return
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to marshal response: %v", err)
+		return
+	}
+
+	w.Write(b)
+}
+
+// postAck acknowledges messages received by the device of the session through
+// any kind of subscription.
+func (s *Server) postAck(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendBodyError(w, err)
+		return
+	}
+
+	var req api.AckReq
+	if err = json.Unmarshal(b, &req); err != nil {
+		sendError(w, api.CodeInvalidRequest, "could not parse request: %v", err)
+		return
+	}
+
+	sess := r.Context().Value(contextKeySession).(sessions.Session)
+	username, err := sess.Username()
+	if err != nil {
+		sendError(w, api.CodeInternal, "unable to retrieve username from session: %v", err)
+		return
+	}
+
+	user, err := s.users.Get(username)
+	if err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if err := user.Ack(sess.Device(), req.Ack...); err != nil {
+		sendError(w, errorCode(err, api.CodeInternal), "unable to acknowledge messages: %v", err)
+		return
+	}
+
+	sendOK(w)
+}
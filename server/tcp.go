@@ -0,0 +1,431 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/locshare/api"
+	"github.com/kennylevinsen/locshare/proto"
+	"github.com/kennylevinsen/locshare/sessions"
+	"github.com/kennylevinsen/locshare/users"
+)
+
+// The TCP front-end speaks the framing of the proto package. Every request is
+// a frame with the method in the "m" key:
+//
+//	hello v                 negotiate the framing version; see proto.Conn.
+//	auth  user, pass, caps  log in; replies with the token in "t". caps is a
+//	                        comma separated list of capabilities, and
+//	                        defaults to "interactive".
+//	t     t, user           bind the connection to the session of token t.
+//	                        user is optional, but must match the session.
+//	sub   since, overflow   subscribe the device of the session. Messages are
+//	                        pushed as "p" frames with the sequence number in
+//	                        "s", the kind in "k", the source in "o" and the
+//	                        content in "l".
+//	ack   s                 acknowledge the comma separated sequence numbers.
+//	pub   u, l, ttl         publish l to user u.
+//	ping                    keep the connection open.
+//
+// On success, hello is answered with a "hello" frame, auth with an "auth"
+// frame, t and pub with an "ok" frame, and ack and ping not at all. Failed
+// requests are answered with an "error" frame carrying the api.ErrorCode in
+// "code" and the reason in "error".
+//
+// Connections are closed if no frame arrives within TCPReadTimeout, or within
+// TCPSubscribedReadTimeout once subscribed. Subscribers with nothing to
+// acknowledge send pings to stay connected.
+const (
+	tcpMethodAuth  = "auth"
+	tcpMethodToken = "t"
+	tcpMethodSub   = "sub"
+	tcpMethodAck   = "ack"
+	tcpMethodPub   = "pub"
+	tcpMethodPing  = "ping"
+
+	tcpMethodOK    = "ok"
+	tcpMethodPush  = "p"
+	tcpMethodError = "error"
+)
+
+// TCPReadTimeout and TCPSubscribedReadTimeout bound the wait for the next
+// frame from a TCP client, before and after it subscribes.
+const (
+	TCPReadTimeout           = time.Minute
+	TCPSubscribedReadTimeout = 10 * time.Minute
+)
+
+// ServeTCP accepts connections speaking the framed protocol on l until l is
+// closed.
+func (s *Server) ServeTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		conn := proto.NewConn(c)
+		conn.MaxFrameSize = int(s.limits.Frame)
+
+		tc := &tcpConn{s: s, c: c, conn: conn}
+		go tc.serve()
+	}
+}
+
+type tcpConn struct {
+	s *Server
+	c net.Conn
+
+	// writeLock protects writes to conn, and changes of its version.
+	writeLock sync.Mutex
+	conn      *proto.Conn
+
+	// sess and sub are only touched by the serve goroutine.
+	sess sessions.Session
+	sub  *subscriber
+}
+
+func (tc *tcpConn) write(msg map[string]string) error {
+	tc.writeLock.Lock()
+	defer tc.writeLock.Unlock()
+	return tc.conn.Write(msg)
+}
+
+func (tc *tcpConn) sendError(code api.ErrorCode, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	log.Printf("tcp error: %s: %s", code, msg)
+	tc.write(map[string]string{"m": tcpMethodError, "code": string(code), "error": msg})
+}
+
+func (tc *tcpConn) serve() {
+	defer tc.c.Close()
+	defer func() {
+		if tc.sub != nil {
+			tc.sub.close()
+		}
+	}()
+
+	for {
+		timeout := TCPReadTimeout
+		if tc.sub != nil {
+			timeout = TCPSubscribedReadTimeout
+		}
+		tc.c.SetReadDeadline(time.Now().Add(timeout))
+
+		req, err := tc.conn.Read()
+		if err == io.EOF {
+			return
+		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return
+		}
+		if err != nil {
+			// The stream cannot be trusted to be at the start of a
+			// frame anymore.
+			tc.sendError(api.CodeInvalidRequest, "invalid frame: %v", err)
+			return
+		}
+
+		switch req["m"] {
+		case proto.MethodHello:
+			tc.hello(req)
+		case tcpMethodAuth:
+			tc.auth(req)
+		case tcpMethodToken:
+			tc.token(req)
+		case tcpMethodSub:
+			tc.subscribe(req)
+		case tcpMethodAck:
+			tc.ack(req)
+		case tcpMethodPub:
+			tc.publish(req)
+		case tcpMethodPing:
+		default:
+			tc.sendError(api.CodeInvalidRequest, "no such method: %q", req["m"])
+		}
+	}
+}
+
+func (tc *tcpConn) hello(req map[string]string) {
+	if tc.sub != nil {
+		tc.sendError(api.CodeInvalidRequest, "cannot negotiate version while subscribed")
+		return
+	}
+
+	resp, version, err := proto.Negotiate(req)
+	if err != nil {
+		tc.sendError(api.CodeInvalidRequest, "%v", err)
+		return
+	}
+
+	tc.writeLock.Lock()
+	defer tc.writeLock.Unlock()
+	if err := tc.conn.Write(resp); err != nil {
+		return
+	}
+	tc.conn.Version = version
+}
+
+func (tc *tcpConn) auth(req map[string]string) {
+	username, password := req["user"], req["pass"]
+	if username == "" || password == "" {
+		tc.sendError(api.CodeInvalidRequest, "username and password must not be empty")
+		return
+	}
+
+	wanted := req["caps"]
+	if wanted == "" {
+		wanted = string(sessions.Interactive)
+	}
+
+	caps, err := sessions.ParseCapabilities(strings.Split(wanted, ","))
+	if err != nil {
+		tc.sendError(api.CodeInvalidCapabilities, "invalid capabilities: %v", err)
+		return
+	}
+
+	if err = tc.s.grants.Check(username, caps, false); err != nil {
+		tc.sendError(api.CodeCapabilityNotGranted, "access denied: %v", err)
+		return
+	}
+
+	user, err := tc.s.users.Get(username)
+	if err != nil {
+		tc.sendError(api.CodeAuthFailed, "unable to authenticate")
+		return
+	}
+
+	if err = user.Authenticate(password); err != nil {
+		tc.sendError(errorCode(err, api.CodeAuthFailed), "unable to authenticate")
+		return
+	}
+
+	session, err := tc.s.sessions.New(caps)
+	if err != nil {
+		tc.sendError(errorCode(err, api.CodeInternal), "unable to create session: %v", err)
+		return
+	}
+
+	if err = session.SetUsername(username); err != nil {
+		tc.sendError(errorCode(err, api.CodeInternal), "unable to set up session: %v", err)
+		return
+	}
+
+	tc.write(map[string]string{"m": tcpMethodAuth, "t": session.Token()})
+}
+
+func (tc *tcpConn) token(req map[string]string) {
+	session, err := tc.s.sessions.Get(req["t"])
+	if err == sessions.ErrSessionExpired {
+		tc.sendError(api.CodeSessionExpired, "session expired")
+		return
+	}
+	if err != nil {
+		tc.sendError(api.CodeNoSession, "no such session")
+		return
+	}
+
+	username, err := session.Username()
+	if err != nil {
+		tc.sendError(api.CodeInternal, "unable to retrieve username from session: %v", err)
+		return
+	}
+	if u := req["user"]; u != "" && u != username {
+		tc.sendError(api.CodeAccessDenied, "session does not belong to %s", u)
+		return
+	}
+
+	if tc.sub != nil {
+		tc.sendError(api.CodeInvalidRequest, "cannot change session while subscribed")
+		return
+	}
+
+	tc.sess = session
+	tc.write(map[string]string{"m": tcpMethodOK})
+}
+
+// session returns the session bound to the connection if it is still valid
+// and may do kind on target, and sends an error otherwise.
+func (tc *tcpConn) session(kind sessions.Kind, target string) sessions.Session {
+	if tc.sess == nil {
+		tc.sendError(api.CodeNoSession, "no session; send a token first")
+		return nil
+	}
+	if !tc.sess.IsValid() || tc.sess.Expired(time.Now()) {
+		tc.sendError(api.CodeSessionExpired, "session expired")
+		return nil
+	}
+
+	if err := tc.sess.HasCapability(kind, target); err != nil {
+		tc.sendError(api.CodeCapabilityMissing, "access denied: %v", err)
+		return nil
+	}
+
+	if err := tc.sess.Touch(); err != nil {
+		log.Printf("unable to record session use: %v", err)
+	}
+
+	return tc.sess
+}
+
+func (tc *tcpConn) subscribe(req map[string]string) {
+	sess := tc.session(sessions.Interactive, "")
+	if sess == nil {
+		return
+	}
+
+	if tc.sub != nil {
+		tc.sendError(api.CodeInvalidRequest, "already subscribed")
+		return
+	}
+
+	username, err := sess.Username()
+	if err != nil {
+		tc.sendError(api.CodeInternal, "unable to retrieve username from session: %v", err)
+		return
+	}
+
+	user, err := tc.s.users.Get(username)
+	if err != nil {
+		tc.sendError(errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	opts := tc.s.subscribeOpts
+	if o := req["overflow"]; o != "" {
+		if opts.Overflow, err = users.ParseOverflowPolicy(o); err != nil {
+			tc.sendError(api.CodeInvalidRequest, "invalid overflow policy: %v", err)
+			return
+		}
+	}
+
+	var since uint64
+	if sc := req["since"]; sc != "" {
+		if since, err = strconv.ParseUint(sc, 10, 64); err != nil {
+			tc.sendError(api.CodeInvalidRequest, "since not uint: %v", err)
+			return
+		}
+	}
+
+	device := sess.Device()
+	ch, err := user.Subscribe(device, opts, since)
+	if err != nil {
+		tc.sendError(errorCode(err, api.CodeInternal), "unable to subscribe: %v", err)
+		return
+	}
+
+	tc.sub = &subscriber{sess, user, device, ch}
+	go tc.push(tc.sub)
+}
+
+// push writes the messages of sub to the connection, closing it when the
+// subscription or session ends.
+func (tc *tcpConn) push(sub *subscriber) {
+	defer tc.c.Close()
+
+	touch := time.NewTicker(StreamTouchInterval)
+	defer touch.Stop()
+
+	for {
+		var msg users.UserMessage
+		select {
+		case <-sub.sess.Done():
+			return
+		case <-touch.C:
+			sub.touch()
+			continue
+		case msg = <-sub.ch:
+		}
+
+		if msg == nil || !sub.sess.IsValid() {
+			return
+		}
+
+		if !sub.deliverable(msg) {
+			continue
+		}
+
+		err := tc.write(map[string]string{
+			"m": tcpMethodPush,
+			"s": strconv.FormatUint(msg.Seq(), 10),
+			"k": msg.Kind(),
+			"o": msg.Source(),
+			"l": string(msg.Content()),
+		})
+		if err == proto.ErrFieldTooLarge || err == proto.ErrFrameTooLarge {
+			// The message stays queued for clients that can take it.
+			tc.sendError(api.CodeTooLarge, "message %d too large for framing version; negotiate a later version", msg.Seq())
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (tc *tcpConn) ack(req map[string]string) {
+	if tc.sub == nil {
+		tc.sendError(api.CodeInvalidRequest, "not subscribed")
+		return
+	}
+
+	var seqs []uint64
+	for _, f := range strings.Split(req["s"], ",") {
+		seq, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			tc.sendError(api.CodeInvalidRequest, "sequence number not uint: %v", err)
+			return
+		}
+		seqs = append(seqs, seq)
+	}
+
+	if err := tc.sub.user.Ack(tc.sub.device, seqs...); err != nil {
+		tc.sendError(errorCode(err, api.CodeInternal), "unable to acknowledge messages: %v", err)
+	}
+}
+
+func (tc *tcpConn) publish(req map[string]string) {
+	username := req["u"]
+	sess := tc.session(sessions.Publish, username)
+	if sess == nil {
+		return
+	}
+
+	source, err := sess.Username()
+	if err != nil {
+		tc.sendError(api.CodeInternal, "unable to retrieve username from session: %v", err)
+		return
+	}
+
+	ttl, err := tc.s.messageTTL(req["ttl"])
+	if err != nil {
+		tc.sendError(api.CodeInvalidRequest, "invalid ttl: %v", err)
+		return
+	}
+
+	user, err := tc.s.users.Get(username)
+	if err != nil {
+		tc.sendError(errorCode(err, api.CodeInternal), "unable to retrieve user: %v", err)
+		return
+	}
+
+	if !accepts(user, source) {
+		tc.sendError(api.CodeSharingNotAllowed, "%s does not accept locations from %s", username, source)
+		return
+	}
+
+	if err := user.Publish(source, []byte(req["l"]), ttl, int(tc.s.limits.Quota)); err != nil {
+		tc.sendError(errorCode(err, api.CodeInternal), "publish failed: %v", err)
+		return
+	}
+
+	tc.write(map[string]string{"m": tcpMethodOK})
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/locshare/api"
+	"github.com/kennylevinsen/locshare/sessions"
+)
+
+// CertCheckInterval is how often a CertReloader checks its files for changes.
+const CertCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate loaded from files, reloading it when the
+// files change, so renewed certificates are picked up without a restart.
+type CertReloader struct {
+	certFile, keyFile string
+
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// load loads the certificate if its files have changed since the last load.
+// The caller must hold lock, or have the only reference to cr.
+func (cr *CertReloader) load() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if cr.cert != nil && certInfo.ModTime().Equal(cr.certMod) && keyInfo.ModTime().Equal(cr.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.cert = &cert
+	cr.certMod = certInfo.ModTime()
+	cr.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If reloading fails,
+// such as when only one of the files has been replaced yet, the previous
+// certificate is served.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	if n := time.Now(); n.Sub(cr.lastCheck) >= CertCheckInterval {
+		cr.lastCheck = n
+		if err := cr.load(); err != nil {
+			log.Printf("unable to reload certificate: %v", err)
+		}
+	}
+
+	return cr.cert, nil
+}
+
+// NewTLSConfig returns a TLS configuration serving the certificate in certFile
+// and keyFile, reloading it when they change. If clientCAFile is not empty,
+// clients may present certificates signed by the CAs in it, which lets them
+// log in through /auth/cert. Clients without certificates are still accepted.
+func NewTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		b, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+// CommonNameUser maps a client certificate to the user named by its subject
+// common name.
+func CommonNameUser(cert *x509.Certificate) (string, error) {
+	if cert.Subject.CommonName == "" {
+		return "", errors.New("certificate has no common name")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// authCert logs in the user a verified client certificate maps to, for
+// headless publishers that have no password at hand. The request is an
+// api.AuthReq without password. A username may be given, but must match the
+// certificate. The capabilities are limited by the certificate grant policy,
+// so that a certificate cannot be used to administer the account.
+func (s *Server) authCert(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		sendError(w, api.CodeAuthFailed, "no verified client certificate")
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendBodyError(w, err)
+		return
+	}
+
+	var req api.AuthReq
+	if err = json.Unmarshal(b, &req); err != nil {
+		sendError(w, api.CodeInvalidRequest, "could not parse request: %v", err)
+		return
+	}
+
+	if len(req.Capabilities) == 0 {
+		sendError(w, api.CodeInvalidRequest, "wanted capabilities must be specified")
+		return
+	}
+
+	caps, err := sessions.ParseCapabilities(req.Capabilities)
+	if err != nil {
+		sendError(w, api.CodeInvalidCapabilities, "invalid capabilities: %v", err)
+		return
+	}
+
+	username, err := s.certUser(r.TLS.VerifiedChains[0][0])
+	if err != nil {
+		sendError(w, api.CodeAuthFailed, "unable to authenticate: %v", err)
+		return
+	}
+
+	if req.Username != "" && req.Username != username {
+		sendError(w, api.CodeAccessDenied, "certificate does not belong to %s", req.Username)
+		return
+	}
+
+	if err = s.certGrants.Check(username, caps, req.Refresh); err != nil {
+		sendError(w, api.CodeCapabilityNotGranted, "access denied: %v", err)
+		return
+	}
+
+	if _, err := s.users.Get(username); err != nil {
+		sendError(w, api.CodeAuthFailed, "unable to authenticate")
+		return
+	}
+
+	s.login(w, username, caps, req.Refresh)
+}
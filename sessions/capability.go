@@ -0,0 +1,167 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kind names a capability.
+type Kind string
+
+const (
+	// Interactive allows managing the own account and reading keys.
+	Interactive Kind = "interactive"
+	// Publish allows publishing messages to other users.
+	Publish Kind = "publish"
+	// Destroyer allows deleting the own account.
+	Destroyer Kind = "destroyer"
+	// Admin allows reading statistics of the whole server.
+	Admin Kind = "admin"
+)
+
+// kinds is the registry of known capabilities, mapping them to whether they
+// can be scoped to a single target user.
+var kinds = map[Kind]bool{
+	Interactive: false,
+	Publish:     true,
+	Destroyer:   false,
+	Admin:       false,
+}
+
+var ErrUnknownCapability = errors.New("unknown capability")
+
+// Capability is a right held by a session. A capability with a Target only
+// applies to requests concerning that user, such as "publish:alice", which
+// only allows publishing to alice.
+type Capability struct {
+	Kind   Kind
+	Target string
+}
+
+func (c Capability) String() string {
+	if c.Target == "" {
+		return string(c.Kind)
+	}
+	return string(c.Kind) + ":" + c.Target
+}
+
+// Allows reports whether the capability permits kind on target.
+func (c Capability) Allows(kind Kind, target string) bool {
+	return c.Kind == kind && (c.Target == "" || c.Target == target)
+}
+
+func (c Capability) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Capability) UnmarshalText(b []byte) error {
+	p, err := ParseCapability(string(b))
+	if err != nil {
+		return err
+	}
+	*c = p
+	return nil
+}
+
+// ParseCapability parses a capability of the form "kind" or "kind:target".
+func ParseCapability(s string) (Capability, error) {
+	c := Capability{Kind: Kind(s)}
+	if idx := strings.Index(s, ":"); idx != -1 {
+		c = Capability{Kind: Kind(s[:idx]), Target: s[idx+1:]}
+		if c.Target == "" {
+			return Capability{}, fmt.Errorf("capability %q: empty target", s)
+		}
+	}
+
+	scopable, known := kinds[c.Kind]
+	if !known {
+		return Capability{}, fmt.Errorf("capability %q: %v", s, ErrUnknownCapability)
+	}
+	if c.Target != "" && !scopable {
+		return Capability{}, fmt.Errorf("capability %q: %s cannot be scoped", s, c.Kind)
+	}
+
+	return c, nil
+}
+
+// ParseCapabilities parses a list of capabilities with ParseCapability.
+func ParseCapabilities(list []string) ([]Capability, error) {
+	caps := make([]Capability, len(list))
+	for idx, s := range list {
+		c, err := ParseCapability(s)
+		if err != nil {
+			return nil, err
+		}
+		caps[idx] = c
+	}
+
+	return caps, nil
+}
+
+// GrantPolicy decides which capabilities a login may obtain.
+type GrantPolicy struct {
+	// Allowed lists the capabilities that may be requested at all.
+	Allowed []Kind
+	// Exclusive lists capabilities that must be requested on their own.
+	Exclusive []Kind
+	// NotRefreshable lists capabilities that cannot be obtained together with
+	// a refresh token.
+	NotRefreshable []Kind
+	// Admins lists the users who may obtain Admin. Nobody else can, even if
+	// it is allowed.
+	Admins []string
+}
+
+// DefaultGrantPolicy only hands out the ability to delete an account to
+// dedicated, short-lived sessions. It names no admins.
+var DefaultGrantPolicy = GrantPolicy{
+	Allowed:        []Kind{Interactive, Publish, Destroyer, Admin},
+	Exclusive:      []Kind{Destroyer},
+	NotRefreshable: []Kind{Destroyer, Admin},
+}
+
+// CertGrantPolicy only lets client certificate logins, which are meant for
+// headless publishers, obtain the capabilities needed to publish and to read
+// keys.
+var CertGrantPolicy = GrantPolicy{
+	Allowed: []Kind{Interactive, Publish},
+}
+
+func hasKind(list []Kind, k Kind) bool {
+	for _, l := range list {
+		if l == k {
+			return true
+		}
+	}
+	return false
+}
+
+func isAdmin(admins []string, username string) bool {
+	for _, a := range admins {
+		if a == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an error if a login of username may not obtain capabilities.
+func (p *GrantPolicy) Check(username string, capabilities []Capability, refreshable bool) error {
+	for _, c := range capabilities {
+		if !hasKind(p.Allowed, c.Kind) {
+			return fmt.Errorf("capability %s may not be requested", c)
+		}
+		if c.Kind == Admin && !isAdmin(p.Admins, username) {
+			return fmt.Errorf("capability %s may not be requested by %s", c, username)
+		}
+		if hasKind(p.Exclusive, c.Kind) && len(capabilities) > 1 {
+			return fmt.Errorf("capability %s must be requested alone", c)
+		}
+		if refreshable && hasKind(p.NotRefreshable, c.Kind) {
+			return fmt.Errorf("capability %s cannot be refreshed", c)
+		}
+	}
+
+	return nil
+}
@@ -2,19 +2,37 @@ package sessions
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/kennylevinsen/locshare/store"
 )
 
 type sessionDB struct {
 	sessionLock sync.RWMutex
-	sessions    map[string]Session
+	sessions    map[string]*session
+	refresh     map[string]*refreshRecord
+
+	policy       Policy
+	store        *store.Dir
+	refreshStore *store.Dir
 }
 
-func (db *sessionDB) New(capabilities []string) (Session, error) {
-	db.sessionLock.Lock()
-	session := ""
+// hashToken derives the key a session is stored under. Only the hash is
+// kept, so a leaked database does not leak usable tokens.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// newToken generates a token whose hash is not already taken by a session or
+// refresh token. The caller must hold sessionLock.
+func (db *sessionDB) newToken() (token, id string, err error) {
 	for i := 0; i < 10; i++ {
 		b := make([]byte, 64)
 		_, err := rand.Read(b)
@@ -22,50 +40,275 @@ func (db *sessionDB) New(capabilities []string) (Session, error) {
 			continue
 		}
 		t := base64.URLEncoding.EncodeToString(b)
+		h := hashToken(t)
 
-		if db.sessions[t] == nil {
-			session = t
-			break
+		if db.sessions[h] == nil && db.refresh[h] == nil {
+			return t, h, nil
 		}
 	}
 
-	if session == "" {
-		db.sessionLock.Unlock()
-		return nil, errors.New("unable to create session")
+	return "", "", errors.New("unable to create session")
+}
+
+// add creates and stores a new session. The caller must hold sessionLock.
+func (db *sessionDB) add(family, username, device string, capabilities []Capability, lifetime Lifetime) (*session, error) {
+	token, id, err := db.newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if family == "" {
+		family = id
 	}
 
-	s := newSession(session, capabilities)
-	db.sessions[session] = s
-	db.sessionLock.Unlock()
+	s := newSession(id, token, family, capabilities, lifetime)
+	s.username = username
+	s.device = device
+	s.db = db
+	s.store = db.store
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+
+	db.sessions[id] = s
 	return s, nil
 }
 
-func (db *sessionDB) Get(session string) (Session, error) {
+func (db *sessionDB) New(capabilities []Capability) (Session, error) {
+	db.sessionLock.Lock()
+	defer db.sessionLock.Unlock()
+	return db.add("", "", "", capabilities, db.policy.lifetime(capabilities))
+}
+
+func (db *sessionDB) Get(token string) (Session, error) {
+	id := hashToken(token)
 	db.sessionLock.RLock()
-	s := db.sessions[session]
+	s := db.sessions[id]
 	db.sessionLock.RUnlock()
 	if s == nil {
 		return nil, ErrNoSuchSession
 	}
 
+	if s.Expired(time.Now()) {
+		db.sessionLock.Lock()
+		db.drop(id)
+		db.sessionLock.Unlock()
+		return nil, ErrSessionExpired
+	}
+
 	return s, nil
 }
 
-func (db *sessionDB) Del(session string) error {
-	db.sessionLock.Lock()
-	sess := db.sessions[session]
+// drop invalidates and removes the session with the given ID. The caller
+// must hold sessionLock.
+func (db *sessionDB) drop(id string) error {
+	sess := db.sessions[id]
 	if sess == nil {
-		db.sessionLock.Unlock()
 		return ErrNoSuchSession
 	}
 	sess.Invalidate()
-	delete(db.sessions, session)
-	db.sessionLock.Unlock()
+	if err := sess.remove(); err != nil {
+		return err
+	}
+	delete(db.sessions, id)
+	return nil
+}
+
+// revoke drops the session with the given ID along with every other session
+// and refresh token of its family, so a revoked device cannot log itself back
+// in. The caller must hold sessionLock.
+func (db *sessionDB) revoke(id string) error {
+	sess := db.sessions[id]
+	if sess == nil {
+		return ErrNoSuchSession
+	}
+
+	return db.revokeFamily(sess.family)
+}
+
+// revokeFamily drops all sessions and refresh tokens of a family. The caller
+// must hold sessionLock.
+func (db *sessionDB) revokeFamily(family string) error {
+	for id, s := range db.sessions {
+		if s.family != family {
+			continue
+		}
+		if err := db.drop(id); err != nil {
+			return err
+		}
+	}
+
+	for id, rt := range db.refresh {
+		if rt.Family != family {
+			continue
+		}
+		if err := db.dropRefresh(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *sessionDB) Del(token string) error {
+	db.sessionLock.Lock()
+	defer db.sessionLock.Unlock()
+	return db.revoke(hashToken(token))
+}
+
+func (db *sessionDB) GetID(id string) (Session, error) {
+	db.sessionLock.RLock()
+	s := db.sessions[id]
+	db.sessionLock.RUnlock()
+	if s == nil || s.Expired(time.Now()) {
+		return nil, ErrNoSuchSession
+	}
+
+	return s, nil
+}
+
+func (db *sessionDB) DelID(id string) error {
+	db.sessionLock.Lock()
+	defer db.sessionLock.Unlock()
+	return db.revoke(id)
+}
+
+func (db *sessionDB) List(username string) ([]Session, error) {
+	n := time.Now()
+	db.sessionLock.RLock()
+	defer db.sessionLock.RUnlock()
+
+	var list []Session
+	for _, s := range db.sessions {
+		if s.Expired(n) {
+			continue
+		}
+		if u, _ := s.Username(); u == username {
+			list = append(list, s)
+		}
+	}
+
+	return list, nil
+}
+
+func (db *sessionDB) DelUser(username string) error {
+	db.sessionLock.Lock()
+	defer db.sessionLock.Unlock()
+
+	families := make(map[string]bool)
+	for _, s := range db.sessions {
+		if u, _ := s.Username(); u == username {
+			families[s.family] = true
+		}
+	}
+	for _, rt := range db.refresh {
+		if rt.Username == username {
+			families[rt.Family] = true
+		}
+	}
+
+	for family := range families {
+		if err := db.revokeFamily(family); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func NewDB() SessionDB {
+func (db *sessionDB) Reap() (int, error) {
+	n := time.Now()
+	db.sessionLock.Lock()
+	defer db.sessionLock.Unlock()
+
+	var cnt int
+	for id, s := range db.sessions {
+		if !s.Expired(n) {
+			continue
+		}
+
+		if err := db.drop(id); err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+
+	for id, rt := range db.refresh {
+		if !rt.expired(n) {
+			continue
+		}
+
+		if err := db.dropRefresh(id); err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+
+	return cnt, nil
+}
+
+// NewDB returns an in-memory SessionDB, limiting session lifetimes according
+// to policy.
+func NewDB(policy Policy) SessionDB {
 	return &sessionDB{
-		sessions: make(map[string]Session),
+		sessions: make(map[string]*session),
+		refresh:  make(map[string]*refreshRecord),
+		policy:   policy,
+	}
+}
+
+// NewFileDB returns a SessionDB persisted in the directory at path. Sessions
+// stored by a previous run are restored immediately, keeping the lifetime
+// they were created with.
+func NewFileDB(path string, policy Policy) (SessionDB, error) {
+	s, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := store.Open(filepath.Join(path, "refresh"))
+	if err != nil {
+		return nil, err
+	}
+
+	db := &sessionDB{
+		sessions:     make(map[string]*session),
+		refresh:      make(map[string]*refreshRecord),
+		policy:       policy,
+		store:        s,
+		refreshStore: rs,
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		var rec sessionRecord
+		if err := s.Get(k, &rec); err != nil {
+			return nil, err
+		}
+
+		sess := loadSession(rec)
+		sess.db = db
+		sess.store = s
+		db.sessions[sess.id] = sess
 	}
+
+	keys, err = rs.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		var rec refreshRecord
+		if err := rs.Get(k, &rec); err != nil {
+			return nil, err
+		}
+
+		db.refresh[rec.ID] = &rec
+	}
+
+	return db, nil
 }
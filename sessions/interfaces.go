@@ -1,25 +1,72 @@
 package sessions
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
 	ErrNoSuchSession    = errors.New("no such session")
+	ErrSessionExpired   = errors.New("session expired")
 	ErrNoSuchCapability = errors.New("no such capability")
+
+	ErrRefreshTokenReused = errors.New("refresh token reused")
 )
 
 type Session interface {
+	// ID identifies the session without revealing its token.
+	ID() string
+
 	SetUsername(username string) error
 	Username() (string, error)
 
-	HasCapability(capability string) error
+	// The device the session is bound to, if any.
+	SetDevice(device string) error
+	Device() string
+
+	// HasCapability checks whether the session may do kind on the target
+	// user. Routes not concerning any particular user pass an empty target.
+	HasCapability(kind Kind, target string) error
+	Capabilities() []Capability
 	IsValid() bool
 	Invalidate() error
 
+	// Done returns a channel that is closed when the session is invalidated.
+	Done() <-chan struct{}
+
+	// Expiry
+	Expired(now time.Time) bool
+	Touch() error
+	Created() time.Time
+	LastUsed() time.Time
+	Expires() time.Time
+
 	Token() string
 }
 
 type SessionDB interface {
-	New(capabilities []string) (Session, error)
+	New(capabilities []Capability) (Session, error)
 	Get(token string) (Session, error)
 	Del(token string) error
+
+	// Lookup and removal by session ID, for managing sessions of a user
+	// without knowing their tokens.
+	GetID(id string) (Session, error)
+	DelID(id string) error
+	List(username string) ([]Session, error)
+
+	// DelUser revokes every session and refresh token of a user, along
+	// with the rest of their families.
+	DelUser(username string) error
+
+	// Refresh tokens. NewRefreshable creates a session limited to
+	// AccessTokenLifetime along with a refresh token, which Refresh exchanges
+	// for a new pair. Reusing a refresh token revokes every session created
+	// from the same login.
+	NewRefreshable(username string, capabilities []Capability) (Session, string, error)
+	Refresh(refreshToken string) (Session, string, error)
+
+	// Reap removes all expired sessions and refresh tokens, returning how
+	// many were removed.
+	Reap() (int, error)
 }
@@ -0,0 +1,41 @@
+package sessions
+
+import "time"
+
+// Lifetime limits how long a session stays valid. Absolute is counted from
+// creation, Idle from the last use. A zero duration means no limit.
+type Lifetime struct {
+	Absolute time.Duration
+	Idle     time.Duration
+}
+
+// Policy maps capabilities to the lifetime of sessions holding them. A session
+// with several capabilities gets the most restrictive limits among them.
+type Policy map[Kind]Lifetime
+
+// DefaultPolicy keeps publishing devices logged in for long, while sessions
+// able to destroy accounts or administer the server only live for minutes.
+var DefaultPolicy = Policy{
+	Interactive: {Absolute: 30 * 24 * time.Hour, Idle: 7 * 24 * time.Hour},
+	Publish:     {Absolute: 365 * 24 * time.Hour, Idle: 30 * 24 * time.Hour},
+	Destroyer:   {Absolute: 10 * time.Minute, Idle: 2 * time.Minute},
+	Admin:       {Absolute: time.Hour, Idle: 15 * time.Minute},
+}
+
+func shortest(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func (p Policy) lifetime(capabilities []Capability) Lifetime {
+	var l Lifetime
+	for _, c := range capabilities {
+		cl := p[c.Kind]
+		l.Absolute = shortest(l.Absolute, cl.Absolute)
+		l.Idle = shortest(l.Idle, cl.Idle)
+	}
+
+	return l
+}
@@ -0,0 +1,111 @@
+package sessions
+
+import (
+	"time"
+
+	"github.com/kennylevinsen/locshare/store"
+)
+
+// sessionRecord is the persisted form of a session. The token itself is never
+// stored, only its hash.
+type sessionRecord struct {
+	ID           string   `json:"id"`
+	Family       string   `json:"family"`
+	Capabilities []string `json:"capabilities"`
+	Username     string   `json:"username"`
+	Device       string   `json:"device,omitempty"`
+
+	Created  time.Time     `json:"created"`
+	Expires  time.Time     `json:"expires"`
+	Idle     time.Duration `json:"idle"`
+	LastUsed time.Time     `json:"lastUsed"`
+}
+
+func (s *session) record() sessionRecord {
+	rec := sessionRecord{
+		ID:      s.id,
+		Family:  s.family,
+		Created: s.created,
+		Expires: s.expires,
+		Idle:    s.idle,
+	}
+
+	for _, c := range s.capabilities {
+		rec.Capabilities = append(rec.Capabilities, c.String())
+	}
+
+	s.useLock.RLock()
+	rec.LastUsed = s.lastUsed
+	s.useLock.RUnlock()
+
+	s.usernameLock.RLock()
+	rec.Username = s.username
+	rec.Device = s.device
+	s.usernameLock.RUnlock()
+
+	return rec
+}
+
+// save writes the current state of the session to its store, if any.
+func (s *session) save() error {
+	if s.store == nil {
+		return nil
+	}
+
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	if s.removed {
+		return nil
+	}
+
+	return s.store.Put(s.id, s.record())
+}
+
+// remove deletes the session from its store, and prevents later saves from
+// bringing it back.
+func (s *session) remove() error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	if s.store != nil {
+		err := s.store.Delete(s.id)
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+
+	s.removed = true
+	return nil
+}
+
+func loadSession(rec sessionRecord) *session {
+	// Sessions stored before refresh tokens existed have no family. Each is
+	// its own family, so revoking one does not revoke every other such
+	// session.
+	if rec.Family == "" {
+		rec.Family = rec.ID
+	}
+
+	// Capabilities that are no longer known are dropped rather than failing
+	// the load of the entire database.
+	var caps []Capability
+	for _, cs := range rec.Capabilities {
+		if c, err := ParseCapability(cs); err == nil {
+			caps = append(caps, c)
+		}
+	}
+
+	return &session{
+		id:           rec.ID,
+		family:       rec.Family,
+		capabilities: caps,
+		username:     rec.Username,
+		device:       rec.Device,
+		created:      rec.Created,
+		expires:      rec.Expires,
+		idle:         rec.Idle,
+		valid:        true,
+		done:         make(chan struct{}),
+		lastUsed:     rec.LastUsed,
+		lastSaved:    rec.LastUsed,
+	}
+}
@@ -0,0 +1,172 @@
+package sessions
+
+import (
+	"time"
+
+	"github.com/kennylevinsen/locshare/store"
+)
+
+// AccessTokenLifetime is the lifetime of sessions handed out together with a
+// refresh token. Clients are expected to refresh well before it runs out.
+const AccessTokenLifetime = 15 * time.Minute
+
+// refreshRecord is a refresh token, stored by the hash of the token. Every
+// refresh token belongs to the family of the login that first created it.
+// Refresh tokens can be used once, after which they are kept as used until
+// they expire, so that a replay can be detected.
+type refreshRecord struct {
+	ID           string       `json:"id"`
+	Family       string       `json:"family"`
+	Username     string       `json:"username"`
+	Capabilities []Capability `json:"capabilities"`
+	Device       string       `json:"device,omitempty"`
+	FamilyStart  time.Time    `json:"familyStart"`
+	Expires      time.Time    `json:"expires"`
+	Used         bool         `json:"used"`
+}
+
+func (rt *refreshRecord) expired(now time.Time) bool {
+	return !rt.Expires.IsZero() && now.After(rt.Expires)
+}
+
+// earliest returns the earliest of two deadlines, where a zero time means no
+// deadline.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// issue creates a new access session and refresh token in a family. The
+// absolute lifetime of the policy applies to the family as a whole, while
+// the idle lifetime limits how long each refresh token is usable. The caller
+// must hold sessionLock.
+func (db *sessionDB) issue(family, username, device string, capabilities []Capability, familyStart time.Time) (*session, string, error) {
+	n := time.Now()
+	lifetime := db.policy.lifetime(capabilities)
+
+	var familyEnd time.Time
+	if lifetime.Absolute != 0 {
+		familyEnd = familyStart.Add(lifetime.Absolute)
+	}
+
+	access := Lifetime{
+		Absolute: AccessTokenLifetime,
+		Idle:     lifetime.Idle,
+	}
+	if !familyEnd.IsZero() && familyEnd.Sub(n) < access.Absolute {
+		access.Absolute = familyEnd.Sub(n)
+	}
+
+	s, err := db.add(family, username, device, capabilities, access)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, id, err := db.newToken()
+	if err != nil {
+		db.drop(s.id)
+		return nil, "", err
+	}
+
+	rt := &refreshRecord{
+		ID:           id,
+		Family:       s.family,
+		Username:     username,
+		Capabilities: capabilities,
+		Device:       device,
+		FamilyStart:  familyStart,
+		Expires:      familyEnd,
+	}
+	if lifetime.Idle != 0 {
+		rt.Expires = earliest(rt.Expires, n.Add(lifetime.Idle))
+	}
+
+	if err := db.saveRefresh(rt); err != nil {
+		db.drop(s.id)
+		return nil, "", err
+	}
+
+	db.refresh[id] = rt
+	return s, token, nil
+}
+
+func (db *sessionDB) NewRefreshable(username string, capabilities []Capability) (Session, string, error) {
+	db.sessionLock.Lock()
+	defer db.sessionLock.Unlock()
+	return db.issue("", username, "", capabilities, time.Now())
+}
+
+func (db *sessionDB) Refresh(token string) (Session, string, error) {
+	id := hashToken(token)
+	db.sessionLock.Lock()
+	defer db.sessionLock.Unlock()
+
+	rt := db.refresh[id]
+	if rt == nil {
+		return nil, "", ErrNoSuchSession
+	}
+
+	if rt.expired(time.Now()) {
+		db.dropRefresh(id)
+		return nil, "", ErrSessionExpired
+	}
+
+	if rt.Used {
+		// Either the client or someone who stole the token is replaying
+		// it. We cannot tell which, so the whole family goes.
+		if err := db.revokeFamily(rt.Family); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrRefreshTokenReused
+	}
+
+	rt.Used = true
+	if err := db.saveRefresh(rt); err != nil {
+		return nil, "", err
+	}
+
+	return db.issue(rt.Family, rt.Username, rt.Device, rt.Capabilities, rt.FamilyStart)
+}
+
+// setFamilyDevice binds the unused refresh tokens of a family to a device, so
+// that the sessions they create are bound to it as well.
+func (db *sessionDB) setFamilyDevice(family, device string) error {
+	db.sessionLock.Lock()
+	defer db.sessionLock.Unlock()
+	for _, rt := range db.refresh {
+		if rt.Family != family || rt.Used {
+			continue
+		}
+
+		rt.Device = device
+		if err := db.saveRefresh(rt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveRefresh persists a refresh token, if the database is persistent.
+func (db *sessionDB) saveRefresh(rt *refreshRecord) error {
+	if db.refreshStore == nil {
+		return nil
+	}
+
+	return db.refreshStore.Put(rt.ID, rt)
+}
+
+// dropRefresh removes a refresh token. The caller must hold sessionLock.
+func (db *sessionDB) dropRefresh(id string) error {
+	if db.refreshStore != nil {
+		err := db.refreshStore.Delete(id)
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+
+	delete(db.refresh, id)
+	return nil
+}
@@ -1,21 +1,50 @@
 package sessions
 
-import "sync"
+import (
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/locshare/store"
+)
+
+// touchSaveInterval limits how often the last use of a session is persisted.
+const touchSaveInterval = time.Minute
 
 type session struct {
+	id           string
 	token        string
-	capabilities []string
+	family       string
+	capabilities []Capability
+
+	created time.Time
+	expires time.Time
+	idle    time.Duration
 
 	validLock sync.RWMutex
 	valid     bool
+	done      chan struct{}
 
 	usernameLock sync.RWMutex
 	username     string
+	device       string
+
+	useLock   sync.RWMutex
+	lastUsed  time.Time
+	lastSaved time.Time
+
+	db       *sessionDB
+	saveLock sync.Mutex
+	store    *store.Dir
+	removed  bool
 }
 
-func (s *session) HasCapability(capability string) error {
+func (s *session) ID() string {
+	return s.id
+}
+
+func (s *session) HasCapability(kind Kind, target string) error {
 	for _, c := range s.capabilities {
-		if c == capability {
+		if c.Allows(kind, target) {
 			return nil
 		}
 	}
@@ -23,6 +52,10 @@ func (s *session) HasCapability(capability string) error {
 	return ErrNoSuchCapability
 }
 
+func (s *session) Capabilities() []Capability {
+	return s.capabilities
+}
+
 func (s *session) IsValid() bool {
 	s.validLock.RLock()
 	defer s.validLock.RUnlock()
@@ -31,11 +64,64 @@ func (s *session) IsValid() bool {
 
 func (s *session) Invalidate() error {
 	s.validLock.Lock()
-	s.valid = false
+	if s.valid {
+		s.valid = false
+		close(s.done)
+	}
 	s.validLock.Unlock()
 	return nil
 }
 
+func (s *session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *session) Expired(now time.Time) bool {
+	if !s.expires.IsZero() && now.After(s.expires) {
+		return true
+	}
+
+	s.useLock.RLock()
+	lastUsed := s.lastUsed
+	s.useLock.RUnlock()
+
+	return s.idle != 0 && now.Sub(lastUsed) > s.idle
+}
+
+func (s *session) Created() time.Time {
+	return s.created
+}
+
+// Expires returns when the session expires regardless of use, or the zero
+// time if it only expires when idle.
+func (s *session) Expires() time.Time {
+	return s.expires
+}
+
+func (s *session) LastUsed() time.Time {
+	s.useLock.RLock()
+	defer s.useLock.RUnlock()
+	return s.lastUsed
+}
+
+func (s *session) Touch() error {
+	n := time.Now()
+	s.useLock.Lock()
+	s.lastUsed = n
+	save := n.Sub(s.lastSaved) > touchSaveInterval
+	if save {
+		s.lastSaved = n
+	}
+	s.useLock.Unlock()
+
+	if save {
+		return s.save()
+	}
+	return nil
+}
+
+// Token returns the token of a newly created session. Sessions restored
+// from storage only know the hash of their token, and return "".
 func (s *session) Token() string {
 	return s.token
 }
@@ -48,11 +134,48 @@ func (s *session) Username() (string, error) {
 
 func (s *session) SetUsername(username string) error {
 	s.usernameLock.Lock()
-	defer s.usernameLock.Unlock()
 	s.username = username
-	return nil
+	s.usernameLock.Unlock()
+	return s.save()
+}
+
+func (s *session) Device() string {
+	s.usernameLock.RLock()
+	defer s.usernameLock.RUnlock()
+	return s.device
 }
 
-func newSession(token string, capabilities []string) Session {
-	return &session{token: token, capabilities: capabilities, valid: true}
+func (s *session) SetDevice(device string) error {
+	s.usernameLock.Lock()
+	s.device = device
+	s.usernameLock.Unlock()
+
+	if s.db != nil {
+		if err := s.db.setFamilyDevice(s.family, device); err != nil {
+			return err
+		}
+	}
+	return s.save()
+}
+
+func newSession(id, token, family string, capabilities []Capability, lifetime Lifetime) *session {
+	n := time.Now()
+	s := &session{
+		id:           id,
+		token:        token,
+		family:       family,
+		capabilities: capabilities,
+		created:      n,
+		idle:         lifetime.Idle,
+		valid:        true,
+		done:         make(chan struct{}),
+		lastUsed:     n,
+		lastSaved:    n,
+	}
+
+	if lifetime.Absolute != 0 {
+		s.expires = n.Add(lifetime.Absolute)
+	}
+
+	return s
 }
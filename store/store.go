@@ -0,0 +1,143 @@
+// Package store implements a small crash-safe key/value store backed by a
+// directory. Every key is kept in its own file, and writes go through a
+// temporary file that is synced and renamed into place, so a crash leaves
+// either the old or the new value behind, never a torn one.
+package store
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	valueSuffix = ".json"
+	tmpSuffix   = ".tmp"
+)
+
+var ErrNotFound = errors.New("no such key")
+
+type Dir struct {
+	path string
+}
+
+func (d *Dir) filename(key string) string {
+	return filepath.Join(d.path, hex.EncodeToString([]byte(key))+valueSuffix)
+}
+
+// Put stores the JSON encoding of v under key.
+func (d *Dir) Put(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(d.path, "put-*"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, d.filename(key)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return d.sync()
+}
+
+// Get decodes the value stored under key into v.
+func (d *Dir) Get(key string, v interface{}) error {
+	b, err := ioutil.ReadFile(d.filename(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// Delete removes key from the store.
+func (d *Dir) Delete(key string) error {
+	err := os.Remove(d.filename(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return d.sync()
+}
+
+// Keys lists all keys currently in the store.
+func (d *Dir) Keys() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, valueSuffix) {
+			continue
+		}
+
+		k, err := hex.DecodeString(strings.TrimSuffix(name, valueSuffix))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, string(k))
+	}
+
+	return keys, nil
+}
+
+// sync flushes the directory entry, making renames and removals durable.
+func (d *Dir) sync() error {
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Open opens the store at path, creating it if necessary. Temporary files left
+// behind by interrupted writes are removed.
+func Open(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), tmpSuffix) {
+			os.Remove(filepath.Join(path, e.Name()))
+		}
+	}
+
+	return &Dir{path: path}, nil
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	d, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"alice", "alice/1", "bob"} {
+		if err := d.Put(k, map[string]string{"key": k}); err != nil {
+			t.Fatalf("put %s: %v", k, err)
+		}
+	}
+	if err := d.Put("bob", map[string]string{"key": "bob2"}); err != nil {
+		t.Fatalf("overwriting bob: %v", err)
+	}
+
+	var v map[string]string
+	if err := d.Get("bob", &v); err != nil || v["key"] != "bob2" {
+		t.Fatalf("get bob: got %v, %v", v, err)
+	}
+
+	if err := d.Delete("alice"); err != nil {
+		t.Fatalf("delete alice: %v", err)
+	}
+	if err := d.Delete("alice"); err != ErrNotFound {
+		t.Fatalf("deleting alice twice: got %v, want ErrNotFound", err)
+	}
+	if err := d.Get("alice", &v); err != ErrNotFound {
+		t.Fatalf("get deleted alice: got %v, want ErrNotFound", err)
+	}
+
+	// A reopened directory holds the same keys.
+	d, err = Open(d.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if want := []string{"alice/1", "bob"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got keys %v, want %v", keys, want)
+	}
+}
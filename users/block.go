@@ -0,0 +1,108 @@
+package users
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// PublishBurst is how many messages a source may publish to a user in
+	// quick succession, after which it is limited to one message every
+	// PublishInterval.
+	PublishBurst    = 20
+	PublishInterval = time.Second
+)
+
+// bucket is a token bucket limiting the publishing rate of one source.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(now time.Time) bool {
+	b.tokens += float64(now.Sub(b.last)) / float64(PublishInterval)
+	if b.tokens > PublishBurst {
+		b.tokens = PublishBurst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimit takes a token from the bucket of source, failing with
+// ErrRateLimited if none are available.
+func (u *user) rateLimit(source string) error {
+	n := time.Now()
+	u.rateLock.Lock()
+	defer u.rateLock.Unlock()
+
+	if u.rates == nil {
+		u.rates = make(map[string]*bucket)
+	}
+
+	// Drop buckets that have filled up, they are no different from new ones.
+	for k, b := range u.rates {
+		if n.Sub(b.last) > PublishBurst*PublishInterval {
+			delete(u.rates, k)
+		}
+	}
+
+	b := u.rates[source]
+	if b == nil {
+		b = &bucket{tokens: PublishBurst, last: n}
+		u.rates[source] = b
+	}
+
+	if !b.take(n) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+func (u *user) Block(username string) error {
+	u.sharingLock.Lock()
+	if u.blocked == nil {
+		u.blocked = make(map[string]bool)
+	}
+	u.blocked[username] = true
+	delete(u.sharing, username)
+	u.sharingLock.Unlock()
+
+	if err := u.save(); err != nil {
+		return err
+	}
+	return u.dropMessagesFrom(username)
+}
+
+func (u *user) Unblock(username string) error {
+	u.sharingLock.Lock()
+	if !u.blocked[username] {
+		u.sharingLock.Unlock()
+		return ErrNotBlocked
+	}
+	delete(u.blocked, username)
+	u.sharingLock.Unlock()
+	return u.save()
+}
+
+func (u *user) IsBlocked(username string) bool {
+	u.sharingLock.RLock()
+	defer u.sharingLock.RUnlock()
+	return u.blocked[username]
+}
+
+func (u *user) Blocked() ([]string, error) {
+	u.sharingLock.RLock()
+	list := make([]string, 0, len(u.blocked))
+	for k := range u.blocked {
+		list = append(list, k)
+	}
+	u.sharingLock.RUnlock()
+
+	sort.Strings(list)
+	return list, nil
+}
@@ -1,10 +1,19 @@
 package users
 
-import "sync"
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/kennylevinsen/locshare/store"
+)
 
 type userDB struct {
 	userLock sync.RWMutex
-	users    map[string]User
+	users    map[string]*user
+
+	store    *store.Dir
+	msgStore *store.Dir
 }
 
 func (db *userDB) Get(username string) (User, error) {
@@ -29,24 +38,129 @@ func (db *userDB) New(username, password string) (User, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	u.store = db.store
+	u.msgStore = db.msgStore
+	if err := u.save(); err != nil {
+		return nil, err
+	}
+
 	db.users[username] = u
 	return u, nil
 }
 
 func (db *userDB) Del(username string) error {
 	db.userLock.Lock()
-	if db.users[username] == nil {
+	u := db.users[username]
+	if u == nil {
 		db.userLock.Unlock()
 		return ErrNoSuchUser
 	}
 
+	// The name is released once the user is gone, so other users must not
+	// keep permissions or blocks referring to it.
+	for _, other := range db.users {
+		if other == u {
+			continue
+		}
+		if err := other.forget(username); err != nil {
+			db.userLock.Unlock()
+			return err
+		}
+	}
+
+	if err := u.remove(); err != nil {
+		db.userLock.Unlock()
+		return err
+	}
+
 	delete(db.users, username)
 	db.userLock.Unlock()
 	return nil
 }
 
+func (db *userDB) List() ([]string, error) {
+	db.userLock.RLock()
+	list := make([]string, 0, len(db.users))
+	for username := range db.users {
+		list = append(list, username)
+	}
+	db.userLock.RUnlock()
+
+	sort.Strings(list)
+	return list, nil
+}
+
 func NewDB() UserDB {
 	return &userDB{
-		users: make(map[string]User),
+		users: make(map[string]*user),
+	}
+}
+
+// NewFileDB returns a UserDB persisted in the directory at path. Existing
+// users are loaded immediately, and every change to a user is written back
+// before the call making it returns.
+func NewFileDB(path string) (UserDB, error) {
+	s, err := store.Open(path)
+	if err != nil {
+		return nil, err
 	}
+
+	ms, err := store.Open(filepath.Join(path, "messages"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	db := &userDB{
+		users:    make(map[string]*user),
+		store:    s,
+		msgStore: ms,
+	}
+
+	for _, k := range keys {
+		var rec userRecord
+		if err := s.Get(k, &rec); err != nil {
+			return nil, err
+		}
+
+		u := loadUser(rec)
+		u.store = s
+		u.msgStore = ms
+		db.users[u.username] = u
+	}
+
+	keys, err = ms.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make(map[string][]msgRecord)
+	for _, k := range keys {
+		username, seq, ok := parseMsgKey(k)
+		if !ok {
+			continue
+		}
+
+		if db.users[username] == nil {
+			continue
+		}
+
+		var rec msgRecord
+		if err := ms.Get(k, &rec); err != nil {
+			return nil, err
+		}
+		rec.Seq = seq
+		msgs[username] = append(msgs[username], rec)
+	}
+
+	for username, recs := range msgs {
+		db.users[username].loadMessages(recs)
+	}
+
+	return db, nil
 }
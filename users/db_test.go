@@ -0,0 +1,42 @@
+package users
+
+import "testing"
+
+func TestDelForgetsUser(t *testing.T) {
+	db := NewDB()
+	alice, err := db.New("alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := db.New("carol", "carol-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.New("bob", "bob-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.RequestSharing("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AcceptSharing("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := carol.Block("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Del("bob"); err != nil {
+		t.Fatalf("deleting bob: %v", err)
+	}
+	if _, err := db.New("bob", "other-password"); err != nil {
+		t.Fatalf("recreating bob: %v", err)
+	}
+
+	if alice.SharingAllowed("bob") {
+		t.Error("new bob inherited sharing permission of deleted bob")
+	}
+	if carol.IsBlocked("bob") {
+		t.Error("new bob inherited block of deleted bob")
+	}
+}
@@ -1,21 +1,59 @@
 package users
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
 	ErrNoSuchUser        = errors.New("no such user")
 	ErrUserAlreadyExists = errors.New("user already exists")
+	ErrNoSuchRequest     = errors.New("no such request")
+	ErrNotBlocked        = errors.New("user not blocked")
+	ErrBlocked           = errors.New("source blocked by user")
+	ErrRateLimited       = errors.New("publish rate limit reached; try again later")
+	ErrNoSuchDevice      = errors.New("no such device")
+	ErrQuotaExceeded     = errors.New("message storage quota exceeded")
+	ErrAuthFailed        = errors.New("unable to authenticate")
+	ErrAuthRateLimited   = errors.New("auth try limit reached; try again later")
+	ErrNoIdentityKey     = errors.New("user has no identity key")
+	ErrNoSignedKey       = errors.New("user has no signed key")
+	ErrNoOneTimeKeys     = errors.New("no keys available")
+	ErrNoSuchKey         = errors.New("no such key")
+	ErrKeyIDInUse        = errors.New("key ID already in use")
 )
 
 type UserDB interface {
 	New(username, password string) (User, error)
 	Get(username string) (User, error)
 	Del(username string) error
+	List() ([]string, error)
 }
 
 type UserMessage interface {
+	Seq() uint64
+	Kind() string
 	Source() string
 	Content() []byte
+	// Expires returns when the message expires, or the zero time if it
+	// does not.
+	Expires() time.Time
+}
+
+type Stats struct {
+	Queued  int    `json:"queued"`
+	History int    `json:"history"`
+	Expired uint64 `json:"expired"`
+	// Bytes is the storage used by queued messages, which is limited by the
+	// quota given to Publish.
+	Bytes int `json:"bytes"`
+}
+
+type DeviceInfo struct {
+	ID     string `json:"id"`
+	Queued int    `json:"queued"`
+	Cursor uint64 `json:"cursor"`
+	Online bool   `json:"online"`
 }
 
 type User interface {
@@ -30,9 +68,10 @@ type User interface {
 	SetIdentity(identity []byte) error
 	Identity() (identity []byte, err error)
 
-	// Signed prekey
-	SetTemporaryKey(keyID uint64, key []byte) error
-	TemporaryKey() (keyID uint64, key []byte, err error)
+	// Signed prekey, with its signature by the identity key. Setting the
+	// identity key removes it, as the signature no longer verifies.
+	SetTemporaryKey(keyID uint64, key, signature []byte) error
+	TemporaryKey() (keyID uint64, key, signature []byte, err error)
 
 	// Prekeys
 	SetOneTimeKey(keyID uint64, key []byte) error
@@ -40,8 +79,46 @@ type User interface {
 	PopOneTimeKey() (keyID uint64, key []byte, err error)
 	OneTimeKeys() (keyIDs []uint64, err error)
 
-	// Message management
-	Publish(source string, content []byte) error
-	Subscribe() (<-chan UserMessage, error)
+	// Sharing permissions. Sources ask to share their location with the
+	// user, who can then accept or remove them. Only accepted sources, and
+	// the user itself, may publish to the user.
+	RequestSharing(source string) error
+	AcceptSharing(source string) error
+	RemoveSharing(source string) error
+	Sharing() (map[string]SharingState, error)
+	SharingAllowed(source string) bool
+
+	// Blocking. Blocked users cannot publish to the user or request
+	// sharing, and any sharing permission they had is removed.
+	Block(username string) error
+	Unblock(username string) error
+	IsBlocked(username string) bool
+	Blocked() ([]string, error)
+
+	// Devices. Every device has its own queue of messages, so that devices
+	// do not steal messages from each other. Sessions without a device use
+	// DefaultDevice, which always exists.
+	RegisterDevice(id string) error
+	RemoveDevice(id string) error
+	Devices() ([]DeviceInfo, error)
+
+	// Message management. Messages published with a non-zero ttl are
+	// dropped once it has passed, whether delivered or not. Publish fails
+	// with ErrQuotaExceeded if the unacknowledged messages would exceed
+	// quota bytes; a zero quota means UserStorageQuota.
+	Publish(source string, content []byte, ttl time.Duration, quota int) error
+	// Notify delivers a server generated event caused by source. Events
+	// are not subject to rate limiting, but are dropped if source is
+	// blocked.
+	Notify(source string, content []byte) error
+	Subscribe(device string, opts SubscribeOptions, since uint64) (<-chan UserMessage, error)
 	Unsubscribe(ch <-chan UserMessage) error
+	// Ack removes delivered messages from the queue of a device. Messages
+	// stay queued and are delivered to every new subscription of the device
+	// until they are acknowledged.
+	Ack(device string, seqs ...uint64) error
+	// Expire drops all messages that have expired by now, returning how
+	// many were dropped.
+	Expire(now time.Time) (int, error)
+	Stats() (Stats, error)
 }
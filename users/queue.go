@@ -0,0 +1,457 @@
+package users
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// UserQueueLimit is the number of unacknowledged messages kept for each
+	// device of a user. When the queue is full, the oldest message is
+	// dropped.
+	UserQueueLimit = 1024
+
+	// UserHistoryLimit is the number of recent messages kept for a user
+	// whether acknowledged or not, for subscribers resuming from a cursor.
+	UserHistoryLimit = 256
+
+	// UserStorageQuota is the default quota on the total size in bytes of
+	// the content of the unacknowledged messages of a user. Messages that
+	// would exceed it are rejected until earlier ones are acknowledged or
+	// expire.
+	UserStorageQuota = 4 << 20
+)
+
+// DefaultDevice is the device of sessions that have not registered one. It
+// exists from the creation of the user, so that messages published before any
+// such session subscribes are queued for it, and it cannot be removed.
+const DefaultDevice = ""
+
+// device holds the delivery state of one device of a user. Every device has
+// its own queue of unacknowledged messages, and its cursor is the highest
+// sequence number it has acknowledged.
+type device struct {
+	id          string
+	queue       []msgBox
+	cursor      uint64
+	subscribers []*subscription
+}
+
+// partition splits msgs into those to keep and those to drop, reusing the
+// backing array of msgs for the former.
+func partition(msgs []msgBox, drop func(m msgBox) bool) (kept, dropped []msgBox) {
+	kept = msgs[:0]
+	for _, m := range msgs {
+		if drop(m) {
+			dropped = append(dropped, m)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept, dropped
+}
+
+// enqueue appends m to the queue of d. The caller must hold queueLock.
+func (u *user) enqueue(d *device, m msgBox) {
+	d.queue = append(d.queue, m)
+
+	if u.queued == nil {
+		u.queued = make(map[uint64]int)
+	}
+	if u.queued[m.seq] == 0 {
+		u.queuedBytes += len(m.content)
+	}
+	u.queued[m.seq]++
+}
+
+// dequeued accounts for msgs having been removed from the queue of a device.
+// The caller must hold queueLock.
+func (u *user) dequeued(msgs []msgBox) {
+	for _, m := range msgs {
+		u.queued[m.seq]--
+		if u.queued[m.seq] <= 0 {
+			delete(u.queued, m.seq)
+			u.queuedBytes -= len(m.content)
+		}
+	}
+}
+
+// ack removes the given messages from the queue of d, returning the sequence
+// numbers of those removed. The caller must hold queueLock.
+func (u *user) ack(d *device, acked func(seq uint64) bool) []uint64 {
+	var removed []msgBox
+	d.queue, removed = partition(d.queue, func(m msgBox) bool { return acked(m.seq) })
+	for _, m := range removed {
+		if m.seq > d.cursor {
+			d.cursor = m.seq
+		}
+	}
+
+	u.dequeued(removed)
+	return seqsOf(removed)
+}
+
+// saveAcked persists the acknowledgement of the given messages by a device.
+func (u *user) saveAcked(seqs []uint64) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+
+	if err := u.save(); err != nil {
+		return err
+	}
+	return u.saveMessages(seqs...)
+}
+
+// getDevice returns the named device. The caller must hold queueLock.
+func (u *user) getDevice(id string) (*device, error) {
+	d := u.devices[id]
+	if d == nil {
+		return nil, ErrNoSuchDevice
+	}
+
+	return d, nil
+}
+
+// addDefaultDevice creates DefaultDevice if it does not exist, starting out
+// with an empty queue like registered devices. The caller must hold queueLock,
+// or have the user to itself.
+func (u *user) addDefaultDevice() {
+	if u.devices[DefaultDevice] != nil {
+		return
+	}
+
+	if u.devices == nil {
+		u.devices = make(map[string]*device)
+	}
+	u.devices[DefaultDevice] = &device{id: DefaultDevice, cursor: u.nextSeq}
+}
+
+func (u *user) RegisterDevice(id string) error {
+	u.queueLock.Lock()
+	if u.devices[id] != nil || id == DefaultDevice {
+		u.queueLock.Unlock()
+		return nil
+	}
+
+	if u.devices == nil {
+		u.devices = make(map[string]*device)
+	}
+
+	// New devices start out with an empty queue. Older messages can still
+	// be fetched from the history by subscribing with a cursor.
+	u.devices[id] = &device{id: id, cursor: u.nextSeq}
+	u.queueLock.Unlock()
+	return u.save()
+}
+
+func (u *user) RemoveDevice(id string) error {
+	if id == DefaultDevice {
+		return ErrNoSuchDevice
+	}
+
+	u.queueLock.Lock()
+	d := u.devices[id]
+	if d == nil {
+		u.queueLock.Unlock()
+		return ErrNoSuchDevice
+	}
+
+	for _, s := range d.subscribers {
+		s.queueLock.Lock()
+		s.close()
+		s.queueLock.Unlock()
+	}
+	delete(u.devices, id)
+	u.dequeued(d.queue)
+	u.queueLock.Unlock()
+
+	if err := u.save(); err != nil {
+		return err
+	}
+	return u.saveMessages(seqsOf(d.queue)...)
+}
+
+// seqsOf returns the sequence numbers of msgs.
+func seqsOf(msgs []msgBox) []uint64 {
+	seqs := make([]uint64, len(msgs))
+	for i, m := range msgs {
+		seqs[i] = m.seq
+	}
+	return seqs
+}
+
+func (u *user) Devices() ([]DeviceInfo, error) {
+	u.queueLock.RLock()
+	list := make([]DeviceInfo, 0, len(u.devices))
+	for _, d := range u.devices {
+		list = append(list, DeviceInfo{
+			ID:     d.id,
+			Queued: len(d.queue),
+			Cursor: d.cursor,
+			Online: len(d.subscribers) > 0,
+		})
+	}
+	u.queueLock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// dropMessagesFrom removes all queued messages from source.
+func (u *user) dropMessagesFrom(source string) error {
+	from := func(m msgBox) bool { return m.source == source }
+	var seqs []uint64
+
+	u.queueLock.Lock()
+	for _, d := range u.devices {
+		var dropped []msgBox
+		d.queue, dropped = partition(d.queue, from)
+		u.dequeued(dropped)
+		seqs = append(seqs, seqsOf(dropped)...)
+	}
+	var dropped []msgBox
+	u.history, dropped = partition(u.history, from)
+	seqs = append(seqs, seqsOf(dropped)...)
+	u.queueLock.Unlock()
+
+	return u.saveMessages(seqs...)
+}
+
+func (u *user) Publish(source string, content []byte, ttl time.Duration, quota int) error {
+	if u.IsBlocked(source) {
+		return ErrBlocked
+	}
+	if err := u.rateLimit(source); err != nil {
+		return err
+	}
+
+	m := msgBox{kind: KindMessage, source: source, content: content}
+	if ttl > 0 {
+		m.expires = time.Now().Add(ttl)
+	}
+
+	if quota == 0 {
+		quota = UserStorageQuota
+	}
+	return u.deliver(m, quota)
+}
+
+func (u *user) Notify(source string, content []byte) error {
+	if u.IsBlocked(source) {
+		return nil
+	}
+
+	return u.deliver(msgBox{kind: KindEvent, source: source, content: content}, 0)
+}
+
+// deliver assigns the message a sequence number, and queues it for every
+// device of the user until acknowledged, handing it to the current
+// subscribers of each device. Subscribers have their own queues, so a slow
+// subscriber never holds up the publisher. If quota is not zero, the message
+// is rejected if the unacknowledged messages would exceed quota bytes with it.
+func (u *user) deliver(m msgBox, quota int) error {
+	u.queueLock.Lock()
+
+	// The quota is checked under the same lock as the message is queued,
+	// so that concurrent publishers cannot all slip under it.
+	if quota != 0 && u.queuedBytes+len(m.content) > quota {
+		u.queueLock.Unlock()
+		return ErrQuotaExceeded
+	}
+
+	u.nextSeq++
+	m.seq = u.nextSeq
+
+	// Only the new message, and those it pushes out of full queues, need
+	// their records written.
+	changed := []uint64{m.seq}
+	for _, d := range u.devices {
+		if len(d.queue) >= UserQueueLimit {
+			n := len(d.queue) - UserQueueLimit + 1
+			changed = append(changed, seqsOf(d.queue[:n])...)
+			u.dequeued(d.queue[:n])
+			d.queue = d.queue[n:]
+		}
+		u.enqueue(d, m)
+
+		for _, s := range d.subscribers {
+			s.push(m)
+		}
+	}
+
+	if len(u.history) >= UserHistoryLimit {
+		n := len(u.history) - UserHistoryLimit + 1
+		changed = append(changed, seqsOf(u.history[:n])...)
+		u.history = u.history[n:]
+	}
+	u.history = append(u.history, m)
+
+	u.queueLock.Unlock()
+
+	return u.saveMessages(changed...)
+}
+
+// replay returns the messages a subscription of d resuming after since must
+// receive: every message after since that is still queued for d or retained
+// in the history, in order. If messages after since have been lost, a KindGap
+// message comes first. The caller must hold queueLock.
+func (u *user) replay(d *device, since uint64) []msgBox {
+	n := time.Now()
+	if since == 0 {
+		var msgs []msgBox
+		for _, m := range d.queue {
+			if !m.expired(n) {
+				msgs = append(msgs, m)
+			}
+		}
+		return msgs
+	}
+
+	seen := make(map[uint64]bool)
+	var msgs []msgBox
+	for _, list := range [][]msgBox{d.queue, u.history} {
+		for _, m := range list {
+			if m.seq > since && !seen[m.seq] && !m.expired(n) {
+				seen[m.seq] = true
+				msgs = append(msgs, m)
+			}
+		}
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].seq < msgs[j].seq
+	})
+
+	first := u.nextSeq + 1
+	if len(msgs) > 0 {
+		first = msgs[0].seq
+	}
+	if since+1 < first {
+		gap := msgBox{kind: KindGap, content: []byte(fmt.Sprintf("%d-%d", since+1, first-1))}
+		msgs = append([]msgBox{gap}, msgs...)
+	}
+
+	return msgs
+}
+
+// Subscribe starts a subscription for a device. If since is zero, the
+// subscription first receives every message not yet acknowledged by the
+// device. Otherwise, since is the last sequence number seen by the
+// subscriber, which acknowledges every message up to and including it, and
+// the subscription receives everything after it. Messages dropped from a
+// subscription by its overflow policy stay queued, and are delivered again to
+// the next subscription.
+func (u *user) Subscribe(deviceID string, opts SubscribeOptions, since uint64) (<-chan UserMessage, error) {
+	u.queueLock.Lock()
+	d, err := u.getDevice(deviceID)
+	if err != nil {
+		u.queueLock.Unlock()
+		return nil, err
+	}
+
+	s := newSubscription(opts)
+	for _, m := range u.replay(d, since) {
+		s.push(m)
+	}
+
+	var acked []uint64
+	if since != 0 {
+		acked = u.ack(d, func(seq uint64) bool { return seq <= since })
+	}
+
+	d.subscribers = append(d.subscribers, s)
+	u.queueLock.Unlock()
+
+	return s.out, u.saveAcked(acked)
+}
+
+func (u *user) Unsubscribe(ch <-chan UserMessage) error {
+	u.queueLock.Lock()
+	defer u.queueLock.Unlock()
+	for _, d := range u.devices {
+		for i, s := range d.subscribers {
+			if s.out == ch {
+				s.queueLock.Lock()
+				s.close()
+				s.queueLock.Unlock()
+				d.subscribers = append(d.subscribers[:i], d.subscribers[i+1:]...)
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("no such subcription")
+}
+
+func (u *user) Ack(deviceID string, seqs ...uint64) error {
+	acked := make(map[uint64]bool, len(seqs))
+	for _, seq := range seqs {
+		acked[seq] = true
+	}
+
+	u.queueLock.Lock()
+	d, err := u.getDevice(deviceID)
+	if err != nil {
+		u.queueLock.Unlock()
+		return err
+	}
+
+	removed := u.ack(d, func(seq uint64) bool { return acked[seq] })
+	u.queueLock.Unlock()
+
+	return u.saveAcked(removed)
+}
+
+func (u *user) Expire(now time.Time) (int, error) {
+	// A message is counted once, even if it was queued for several devices
+	// and kept in the history.
+	expired := make(map[uint64]bool)
+	drop := func(m msgBox) bool {
+		if m.expired(now) {
+			expired[m.seq] = true
+			return true
+		}
+		return false
+	}
+
+	u.queueLock.Lock()
+	u.history, _ = partition(u.history, drop)
+	for _, d := range u.devices {
+		var dropped []msgBox
+		d.queue, dropped = partition(d.queue, drop)
+		u.dequeued(dropped)
+	}
+	u.expired += uint64(len(expired))
+	u.queueLock.Unlock()
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	seqs := make([]uint64, 0, len(expired))
+	for seq := range expired {
+		seqs = append(seqs, seq)
+	}
+	if err := u.save(); err != nil {
+		return 0, err
+	}
+	return len(expired), u.saveMessages(seqs...)
+}
+
+func (u *user) Stats() (Stats, error) {
+	u.queueLock.RLock()
+	defer u.queueLock.RUnlock()
+	st := Stats{
+		History: len(u.history),
+		Expired: u.expired,
+		Bytes:   u.queuedBytes,
+	}
+	for _, d := range u.devices {
+		st.Queued += len(d.queue)
+	}
+	return st, nil
+}
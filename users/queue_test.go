@@ -0,0 +1,204 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestUser returns a user of a new in-memory database.
+func newTestUser(t *testing.T) *user {
+	t.Helper()
+	u, err := NewDB().New("alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.(*user)
+}
+
+// receive waits for the next message of ch.
+func receive(t *testing.T, ch <-chan UserMessage) UserMessage {
+	t.Helper()
+	select {
+	case m, ok := <-ch:
+		if !ok {
+			t.Fatal("subscription ended")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return nil
+}
+
+func TestSubscribeAfterPublish(t *testing.T) {
+	u := newTestUser(t)
+	if err := u.Publish("alice", []byte("early"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := u.Subscribe(DefaultDevice, SubscribeOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Unsubscribe(ch)
+
+	if m := receive(t, ch); m.Seq() != 1 || string(m.Content()) != "early" {
+		t.Fatalf("got message %d %q, want 1 \"early\"", m.Seq(), m.Content())
+	}
+}
+
+// queued returns the number of messages queued for each device of u.
+func queued(t *testing.T, u User) map[string]int {
+	t.Helper()
+	devices, err := u.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := make(map[string]int)
+	for _, d := range devices {
+		m[d.ID] = d.Queued
+	}
+	return m
+}
+
+func TestAck(t *testing.T) {
+	u := newTestUser(t)
+	if err := u.RegisterDevice("phone"); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"one", "two", "three"} {
+		if err := u.Publish("alice", []byte(content), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := u.Ack(DefaultDevice, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if q := queued(t, u); q[DefaultDevice] != 1 || q["phone"] != 3 {
+		t.Fatalf("queued %v after acking on one device, want 1 and 3", q)
+	}
+
+	// Messages count against the quota until every device has acked them.
+	st, _ := u.Stats()
+	if st.Bytes != len("onetwothree") {
+		t.Fatalf("got %d bytes queued, want %d", st.Bytes, len("onetwothree"))
+	}
+
+	if err := u.Ack("phone", 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	st, _ = u.Stats()
+	if st.Queued != 1 || st.Bytes != len("three") {
+		t.Fatalf("got %d messages of %d bytes queued, want 1 of %d", st.Queued, st.Bytes, len("three"))
+	}
+
+	if err := u.Ack("tablet", 3); err != ErrNoSuchDevice {
+		t.Fatalf("acking on unknown device: got %v, want ErrNoSuchDevice", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	u := newTestUser(t)
+	if err := u.Publish("alice", []byte("123456"), 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Publish("alice", []byte("123456"), 0, 10); err != ErrQuotaExceeded {
+		t.Fatalf("publishing over quota: got %v, want ErrQuotaExceeded", err)
+	}
+
+	if err := u.Ack(DefaultDevice, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Publish("alice", []byte("123456"), 0, 10); err != nil {
+		t.Fatalf("publishing after ack: %v", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	u := newTestUser(t)
+	if err := u.Publish("alice", []byte("short"), time.Minute, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Publish("alice", []byte("forever"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := u.Expire(time.Now())
+	if err != nil || n != 0 {
+		t.Fatalf("expiring early: got %d, %v, want 0", n, err)
+	}
+
+	n, err = u.Expire(time.Now().Add(time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("expiring: got %d, %v, want 1", n, err)
+	}
+
+	st, _ := u.Stats()
+	if st.Queued != 1 || st.History != 1 || st.Expired != 1 || st.Bytes != len("forever") {
+		t.Fatalf("got %+v after expiry", st)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewFileDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.New("alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.RegisterDevice("phone"); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"one", "two", "three"} {
+		if err := u.Publish("alice", []byte(content), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := u.Ack(DefaultDevice, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Ack("phone", 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewFileDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = db.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q := queued(t, u); len(q) != 2 || q[DefaultDevice] != 2 || q["phone"] != 0 {
+		t.Fatalf("queued %v after reload, want 2 and 0", q)
+	}
+	st, _ := u.Stats()
+	if st.History != 3 || st.Bytes != len("twothree") {
+		t.Fatalf("got %+v after reload", st)
+	}
+
+	ch, err := u.Subscribe(DefaultDevice, SubscribeOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Unsubscribe(ch)
+	for _, want := range []string{"two", "three"} {
+		if m := receive(t, ch); string(m.Content()) != want {
+			t.Fatalf("got %q, want %q", m.Content(), want)
+		}
+	}
+
+	// Sequence numbers continue where they left off.
+	if err := u.Publish("alice", []byte("four"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, ch); m.Seq() != 4 {
+		t.Fatalf("got sequence number %d, want 4", m.Seq())
+	}
+}
@@ -0,0 +1,299 @@
+package users
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/locshare/store"
+)
+
+// keyRecord and userRecord are the persisted forms of keyBox and user.
+// Messages are not part of the user record, as they change far more often.
+// Every message has a record of its own instead, listing the devices it is
+// queued for and whether it is retained in the history.
+type keyRecord struct {
+	ID        uint64 `json:"id"`
+	Key       []byte `json:"key"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+type msgRecord struct {
+	Seq     uint64    `json:"seq"`
+	Kind    string    `json:"kind"`
+	Source  string    `json:"source"`
+	Content []byte    `json:"content"`
+	Expires time.Time `json:"expires"`
+	Devices []string  `json:"devices,omitempty"`
+	History bool      `json:"history,omitempty"`
+}
+
+type deviceRecord struct {
+	ID     string `json:"id"`
+	Cursor uint64 `json:"cursor"`
+}
+
+type userRecord struct {
+	Username     string      `json:"username"`
+	PasswordHash []byte      `json:"passwordHash"`
+	IdentityKey  []byte      `json:"identityKey,omitempty"`
+	SignedKey    *keyRecord  `json:"signedKey,omitempty"`
+	OneTimeKeys  []keyRecord `json:"oneTimeKeys,omitempty"`
+
+	Sharing map[string]SharingState `json:"sharing,omitempty"`
+	Blocked []string                `json:"blocked,omitempty"`
+
+	Devices []deviceRecord `json:"devices,omitempty"`
+	NextSeq uint64         `json:"nextSeq"`
+	Expired uint64         `json:"expired,omitempty"`
+}
+
+// msgKey is the key of the record of a message in the message store.
+func msgKey(username string, seq uint64) string {
+	return username + "/" + strconv.FormatUint(seq, 10)
+}
+
+// parseMsgKey returns the username and sequence number of a message key.
+func parseMsgKey(key string) (string, uint64, bool) {
+	idx := strings.LastIndexByte(key, '/')
+	if idx == -1 {
+		return "", 0, false
+	}
+
+	seq, err := strconv.ParseUint(key[idx+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return key[:idx], seq, true
+}
+
+func (u *user) record() userRecord {
+	rec := userRecord{Username: u.username}
+
+	u.passwordLock.RLock()
+	rec.PasswordHash = u.passwordHash
+	u.passwordLock.RUnlock()
+
+	u.keyLock.RLock()
+	rec.IdentityKey = u.identityKey
+	if u.signedKey != nil {
+		rec.SignedKey = &keyRecord{u.signedKey.id, u.signedKey.key, u.signedKey.signature}
+	}
+	for _, k := range u.keys {
+		rec.OneTimeKeys = append(rec.OneTimeKeys, keyRecord{ID: k.id, Key: k.key})
+	}
+	u.keyLock.RUnlock()
+
+	u.sharingLock.RLock()
+	if len(u.sharing) > 0 {
+		rec.Sharing = make(map[string]SharingState, len(u.sharing))
+		for k, v := range u.sharing {
+			rec.Sharing[k] = v
+		}
+	}
+	for k := range u.blocked {
+		rec.Blocked = append(rec.Blocked, k)
+	}
+	u.sharingLock.RUnlock()
+
+	u.queueLock.RLock()
+	for _, d := range u.devices {
+		rec.Devices = append(rec.Devices, deviceRecord{ID: d.id, Cursor: d.cursor})
+	}
+	rec.NextSeq = u.nextSeq
+	rec.Expired = u.expired
+	u.queueLock.RUnlock()
+
+	return rec
+}
+
+// save writes the current state of the user to its store, if any. The record
+// is taken while holding saveLock, so concurrent saves cannot overwrite a
+// newer state with an older one.
+func (u *user) save() error {
+	if u.store == nil {
+		return nil
+	}
+
+	u.saveLock.Lock()
+	defer u.saveLock.Unlock()
+	if u.removed {
+		return nil
+	}
+
+	return u.store.Put(u.username, u.record())
+}
+
+// msgRecords returns the records of the messages with the given sequence
+// numbers, with a nil record for those no longer queued or retained. The
+// caller must hold queueLock.
+func (u *user) msgRecords(seqs []uint64) map[uint64]*msgRecord {
+	recs := make(map[uint64]*msgRecord, len(seqs))
+	for _, seq := range seqs {
+		recs[seq] = nil
+	}
+
+	get := func(m msgBox) *msgRecord {
+		rec, ok := recs[m.seq]
+		if ok && rec == nil {
+			rec = &msgRecord{Seq: m.seq, Kind: m.kind, Source: m.source, Content: m.content, Expires: m.expires}
+			recs[m.seq] = rec
+		}
+		return rec
+	}
+
+	for _, d := range u.devices {
+		for _, m := range d.queue {
+			if rec := get(m); rec != nil {
+				rec.Devices = append(rec.Devices, d.id)
+			}
+		}
+	}
+	for _, m := range u.history {
+		if rec := get(m); rec != nil {
+			rec.History = true
+		}
+	}
+
+	return recs
+}
+
+// saveMessages writes the records of the messages with the given sequence
+// numbers to the message store, if any, and deletes those of messages no
+// longer queued or retained. Like save, the records are taken while holding
+// saveLock.
+func (u *user) saveMessages(seqs ...uint64) error {
+	if u.msgStore == nil || len(seqs) == 0 {
+		return nil
+	}
+
+	u.saveLock.Lock()
+	defer u.saveLock.Unlock()
+	if u.removed {
+		return nil
+	}
+
+	u.queueLock.RLock()
+	recs := u.msgRecords(seqs)
+	u.queueLock.RUnlock()
+
+	for seq, rec := range recs {
+		if rec != nil {
+			if err := u.msgStore.Put(msgKey(u.username, seq), rec); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := u.msgStore.Delete(msgKey(u.username, seq))
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove deletes the user and its messages from their stores, and prevents
+// later saves from bringing them back.
+func (u *user) remove() error {
+	u.saveLock.Lock()
+	defer u.saveLock.Unlock()
+	if u.msgStore != nil {
+		u.queueLock.RLock()
+		seqs := make(map[uint64]bool)
+		for _, d := range u.devices {
+			for _, m := range d.queue {
+				seqs[m.seq] = true
+			}
+		}
+		for _, m := range u.history {
+			seqs[m.seq] = true
+		}
+		u.queueLock.RUnlock()
+
+		for seq := range seqs {
+			err := u.msgStore.Delete(msgKey(u.username, seq))
+			if err != nil && err != store.ErrNotFound {
+				return err
+			}
+		}
+	}
+
+	if u.store != nil {
+		err := u.store.Delete(u.username)
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+
+	u.removed = true
+	return nil
+}
+
+func loadUser(rec userRecord) *user {
+	u := &user{
+		username:     rec.Username,
+		passwordHash: rec.PasswordHash,
+		identityKey:  rec.IdentityKey,
+		sharing:      rec.Sharing,
+		nextSeq:      rec.NextSeq,
+		expired:      rec.Expired,
+	}
+
+	for _, dr := range rec.Devices {
+		if u.devices == nil {
+			u.devices = make(map[string]*device)
+		}
+		u.devices[dr.ID] = &device{id: dr.ID, cursor: dr.Cursor}
+	}
+
+	// Users stored before DefaultDevice existed from the start get it now.
+	u.addDefaultDevice()
+
+	if len(rec.Blocked) > 0 {
+		u.blocked = make(map[string]bool, len(rec.Blocked))
+		for _, b := range rec.Blocked {
+			u.blocked[b] = true
+		}
+	}
+
+	// Signed keys stored before signatures were required are dropped, as
+	// clients cannot verify them. The user must upload a new one.
+	if rec.SignedKey != nil && len(rec.SignedKey.Signature) > 0 {
+		u.signedKey = &keyBox{rec.SignedKey.ID, rec.SignedKey.Key, rec.SignedKey.Signature}
+	}
+	for _, k := range rec.OneTimeKeys {
+		u.keys = append(u.keys, keyBox{id: k.ID, key: k.Key})
+	}
+
+	return u
+}
+
+// loadMessages queues and retains the messages of the user as told by their
+// records. Messages for devices that no longer exist are only kept for the
+// others.
+func (u *user) loadMessages(recs []msgRecord) {
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Seq < recs[j].Seq
+	})
+
+	for _, rec := range recs {
+		m := msgBox{rec.Seq, rec.Kind, rec.Source, rec.Content, rec.Expires}
+		for _, id := range rec.Devices {
+			if d := u.devices[id]; d != nil {
+				u.enqueue(d, m)
+			}
+		}
+		if rec.History {
+			u.history = append(u.history, m)
+		}
+
+		// Records are written before the user record is, so the sequence
+		// number may be ahead of it.
+		if m.seq > u.nextSeq {
+			u.nextSeq = m.seq
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package users
+
+import "testing"
+
+func TestLoadUnsignedKey(t *testing.T) {
+	u := loadUser(userRecord{
+		Username:  "alice",
+		SignedKey: &keyRecord{ID: 1, Key: []byte("key")},
+	})
+
+	if _, _, _, err := u.TemporaryKey(); err != ErrNoSignedKey {
+		t.Fatalf("got %v, want ErrNoSignedKey", err)
+	}
+}
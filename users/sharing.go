@@ -0,0 +1,84 @@
+package users
+
+// SharingState is the state of a request to share locations with a user.
+type SharingState string
+
+const (
+	SharingPending  SharingState = "pending"
+	SharingAccepted SharingState = "accepted"
+)
+
+func (u *user) RequestSharing(source string) error {
+	u.sharingLock.Lock()
+	if u.sharing[source] != "" || u.blocked[source] {
+		// Requests from blocked sources are dropped without telling them.
+		u.sharingLock.Unlock()
+		return nil
+	}
+
+	if u.sharing == nil {
+		u.sharing = make(map[string]SharingState)
+	}
+	u.sharing[source] = SharingPending
+	u.sharingLock.Unlock()
+	return u.save()
+}
+
+func (u *user) AcceptSharing(source string) error {
+	u.sharingLock.Lock()
+	if u.sharing[source] == "" {
+		u.sharingLock.Unlock()
+		return ErrNoSuchRequest
+	}
+
+	u.sharing[source] = SharingAccepted
+	u.sharingLock.Unlock()
+	return u.save()
+}
+
+func (u *user) RemoveSharing(source string) error {
+	u.sharingLock.Lock()
+	if u.sharing[source] == "" {
+		u.sharingLock.Unlock()
+		return ErrNoSuchRequest
+	}
+
+	delete(u.sharing, source)
+	u.sharingLock.Unlock()
+	return u.save()
+}
+
+func (u *user) Sharing() (map[string]SharingState, error) {
+	u.sharingLock.RLock()
+	defer u.sharingLock.RUnlock()
+	m := make(map[string]SharingState, len(u.sharing))
+	for k, v := range u.sharing {
+		m[k] = v
+	}
+	return m, nil
+}
+
+func (u *user) SharingAllowed(source string) bool {
+	if source == u.username {
+		return true
+	}
+
+	u.sharingLock.RLock()
+	defer u.sharingLock.RUnlock()
+	return u.sharing[source] == SharingAccepted
+}
+
+// forget removes any sharing permission and block of username, so that a
+// user later registered under the name inherits neither.
+func (u *user) forget(username string) error {
+	u.sharingLock.Lock()
+	if u.sharing[username] == "" && !u.blocked[username] {
+		u.sharingLock.Unlock()
+		return nil
+	}
+
+	delete(u.sharing, username)
+	delete(u.blocked, username)
+	u.sharingLock.Unlock()
+	return u.save()
+}
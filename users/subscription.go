@@ -0,0 +1,144 @@
+package users
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to a subscription whose queue is full
+// because the subscriber does not keep up.
+type OverflowPolicy string
+
+const (
+	// DropOldest drops the oldest queued message.
+	DropOldest OverflowPolicy = "drop-oldest"
+	// CoalesceLatest drops the oldest queued message from the source of the
+	// new message, or the oldest message if there is none.
+	CoalesceLatest OverflowPolicy = "coalesce"
+	// Disconnect ends the subscription.
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+// ParseOverflowPolicy parses the name of an overflow policy.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case DropOldest, CoalesceLatest, Disconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", s)
+	}
+}
+
+type SubscribeOptions struct {
+	// QueueLimit is the number of messages that can be queued for the
+	// subscriber before Overflow applies.
+	QueueLimit int
+	Overflow   OverflowPolicy
+}
+
+var DefaultSubscribeOptions = SubscribeOptions{
+	QueueLimit: 256,
+	Overflow:   CoalesceLatest,
+}
+
+// subscription queues messages for a subscriber. Messages are pushed to the
+// queue without blocking, and a goroutine moves them from the queue to the
+// channel read by the subscriber.
+type subscription struct {
+	opts SubscribeOptions
+
+	queueLock sync.Mutex
+	queue     []msgBox
+	closed    bool
+
+	wake chan struct{}
+	done chan struct{}
+	out  chan UserMessage
+}
+
+// push queues a message, applying the overflow policy if the queue is full.
+// It never blocks.
+func (s *subscription) push(m msgBox) {
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	if s.closed {
+		return
+	}
+
+	if len(s.queue) >= s.opts.QueueLimit && s.opts.Overflow == CoalesceLatest && m.kind == KindMessage {
+		for i, mb := range s.queue {
+			if mb.kind == KindMessage && mb.source == m.source {
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if len(s.queue) >= s.opts.QueueLimit {
+		if s.opts.Overflow == Disconnect {
+			s.close()
+			return
+		}
+		s.queue = s.queue[len(s.queue)-s.opts.QueueLimit+1:]
+	}
+
+	s.queue = append(s.queue, m)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close ends the subscription. The caller must hold queueLock.
+func (s *subscription) close() {
+	if !s.closed {
+		s.closed = true
+		s.queue = nil
+		close(s.done)
+	}
+}
+
+func (s *subscription) run() {
+	defer close(s.out)
+	for {
+		s.queueLock.Lock()
+		if len(s.queue) == 0 {
+			s.queueLock.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		m := s.queue[0]
+		s.queue = s.queue[1:]
+		s.queueLock.Unlock()
+
+		select {
+		case s.out <- m:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func newSubscription(opts SubscribeOptions) *subscription {
+	if opts.QueueLimit <= 0 {
+		opts.QueueLimit = DefaultSubscribeOptions.QueueLimit
+	}
+	if opts.Overflow == "" {
+		opts.Overflow = DefaultSubscribeOptions.Overflow
+	}
+
+	s := &subscription{
+		opts: opts,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+		out:  make(chan UserMessage),
+	}
+	go s.run()
+	return s
+}
@@ -0,0 +1,39 @@
+package users
+
+import "testing"
+
+func TestCoalesceLatest(t *testing.T) {
+	s := &subscription{
+		opts: SubscribeOptions{QueueLimit: 3, Overflow: CoalesceLatest},
+		wake: make(chan struct{}, 1),
+	}
+
+	push := func(seq uint64, source string) {
+		s.push(msgBox{seq: seq, kind: KindMessage, source: source})
+	}
+	queued := func() []uint64 {
+		var seqs []uint64
+		for _, m := range s.queue {
+			seqs = append(seqs, m.seq)
+		}
+		return seqs
+	}
+
+	// Messages are only coalesced once the queue is full.
+	push(1, "bob")
+	push(2, "bob")
+	push(3, "carol")
+	if got := queued(); len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Fatalf("queued %v, want [1 2 3]", got)
+	}
+
+	push(4, "carol")
+	if got := queued(); len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 4 {
+		t.Fatalf("queued %v, want [1 2 4]", got)
+	}
+
+	push(5, "dave")
+	if got := queued(); len(got) != 3 || got[0] != 2 || got[1] != 4 || got[2] != 5 {
+		t.Fatalf("queued %v, want [2 4 5]", got)
+	}
+}
@@ -1,22 +1,50 @@
 package users
 
 import (
-	"fmt"
+	"bytes"
 	"sync"
 	"time"
 
+	"github.com/kennylevinsen/locshare/store"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	LoginRetryTimeLimit = time.Minute
 	LoginRetryCount     = 3
-	UserBufferLimit     = 64
+)
+
+// Message kinds. Messages are opaque content from publishers, while events
+// are generated by the server to tell the user about changes, such as to the
+// membership of groups.
+const (
+	KindMessage = "message"
+	KindEvent   = "event"
+
+	// KindGap tells a resuming subscriber that messages have been lost. Its
+	// content holds the range of lost sequence numbers, such as "4-9".
+	KindGap = "gap"
 )
 
 type msgBox struct {
+	seq     uint64
+	kind    string
 	source  string
 	content []byte
+	expires time.Time
+}
+
+func (m msgBox) expired(now time.Time) bool {
+	return !m.expires.IsZero() && now.After(m.expires)
+}
+
+func (m msgBox) Seq() uint64 {
+	return m.seq
+}
+
+func (m msgBox) Kind() string {
+	return m.kind
 }
 
 func (m msgBox) Source() string {
@@ -27,9 +55,16 @@ func (m msgBox) Content() []byte {
 	return m.content
 }
 
+func (m msgBox) Expires() time.Time {
+	return m.expires
+}
+
 type keyBox struct {
 	id  uint64
 	key []byte
+
+	// signature is only set for the signed key.
+	signature []byte
 }
 
 type keyRespBox struct {
@@ -44,11 +79,23 @@ type user struct {
 	passwordLock sync.RWMutex
 	passwordHash []byte
 
-	locationBufferLock sync.RWMutex
-	locationBuffer     []msgBox
+	queueLock sync.RWMutex
+	devices   map[string]*device
+	history   []msgBox
+	nextSeq   uint64
+	expired   uint64
+
+	// queued counts the device queues holding each message, and queuedBytes
+	// is the size of the content of the messages in it.
+	queued      map[uint64]int
+	queuedBytes int
 
-	subscriberLock sync.RWMutex
-	subscribers    []chan UserMessage
+	sharingLock sync.RWMutex
+	sharing     map[string]SharingState
+	blocked     map[string]bool
+
+	rateLock sync.Mutex
+	rates    map[string]*bucket
 
 	keyLock     sync.RWMutex
 	keys        []keyBox
@@ -58,6 +105,11 @@ type user struct {
 	authLock     sync.RWMutex
 	authFailCnt  int
 	authFailTime time.Time
+
+	saveLock sync.Mutex
+	store    *store.Dir
+	msgStore *store.Dir
+	removed  bool
 }
 
 func (u *user) Username() string {
@@ -73,7 +125,7 @@ func (u *user) SetPassword(password string) error {
 	}
 	u.passwordHash = pass
 	u.passwordLock.Unlock()
-	return nil
+	return u.save()
 }
 
 func (u *user) authSuccess() error {
@@ -90,7 +142,7 @@ func (u *user) authFail() error {
 	u.authFailCnt++
 	u.authLock.Unlock()
 
-	return fmt.Errorf("unable to authenticate")
+	return ErrAuthFailed
 }
 
 func (u *user) authRateLimit() error {
@@ -102,7 +154,7 @@ func (u *user) authRateLimit() error {
 	n := time.Now()
 	if n.Sub(authFailTime) < LoginRetryTimeLimit {
 		if authFailCnt > LoginRetryCount {
-			return fmt.Errorf("auth try limit reached; try again later")
+			return ErrAuthRateLimited
 		}
 	}
 
@@ -126,72 +178,85 @@ func (u *user) Authenticate(password string) error {
 
 func (u *user) SetIdentity(identity []byte) error {
 	u.keyLock.Lock()
-	defer u.keyLock.Unlock()
+	if !bytes.Equal(u.identityKey, identity) {
+		u.signedKey = nil
+	}
 	u.identityKey = identity
-	return nil
+	u.keyLock.Unlock()
+	return u.save()
 }
 
 func (u *user) Identity() ([]byte, error) {
 	u.keyLock.RLock()
 	defer u.keyLock.RUnlock()
 	if u.identityKey == nil {
-		return nil, fmt.Errorf("user has no identity key")
+		return nil, ErrNoIdentityKey
 	}
 	return u.identityKey, nil
 }
 
-func (u *user) SetTemporaryKey(keyID uint64, key []byte) error {
+func (u *user) SetTemporaryKey(keyID uint64, key, signature []byte) error {
 	u.keyLock.Lock()
-	defer u.keyLock.Unlock()
-	u.signedKey = &keyBox{keyID, key}
-	return nil
+	u.signedKey = &keyBox{keyID, key, signature}
+	u.keyLock.Unlock()
+	return u.save()
 }
 
-func (u *user) TemporaryKey() (uint64, []byte, error) {
+func (u *user) TemporaryKey() (uint64, []byte, []byte, error) {
 	u.keyLock.RLock()
 	defer u.keyLock.RUnlock()
+
 	if u.signedKey == nil {
-		return 0, nil, fmt.Errorf("user has no signed key")
+		return 0, nil, nil, ErrNoSignedKey
 	}
 	k := u.signedKey
-	return k.id, k.key, nil
+	return k.id, k.key, k.signature, nil
 }
 
 func (u *user) SetOneTimeKey(keyID uint64, key []byte) error {
 	u.keyLock.Lock()
-	defer u.keyLock.Unlock()
 	for _, k := range u.keys {
 		if k.id == keyID {
-			return fmt.Errorf("key ID already in use")
+			u.keyLock.Unlock()
+			return ErrKeyIDInUse
 		}
 	}
 
-	u.keys = append(u.keys, keyBox{keyID, key})
-	return nil
+	u.keys = append(u.keys, keyBox{id: keyID, key: key})
+	u.keyLock.Unlock()
+	return u.save()
 }
 
 func (u *user) RemoveOneTimeKey(keyID uint64) error {
 	u.keyLock.Lock()
-	defer u.keyLock.Unlock()
 	for idx, k := range u.keys {
 		if k.id == keyID {
 			u.keys = append(u.keys[:idx], u.keys[idx+1:]...)
-			return nil
+			u.keyLock.Unlock()
+			return u.save()
 		}
 	}
+	u.keyLock.Unlock()
 
-	return fmt.Errorf("no such key")
+	return ErrNoSuchKey
 }
 
 func (u *user) PopOneTimeKey() (uint64, []byte, error) {
 	u.keyLock.Lock()
-	defer u.keyLock.Unlock()
 	if len(u.keys) == 0 {
-		return 0, nil, fmt.Errorf("no keys available")
+		u.keyLock.Unlock()
+		return 0, nil, ErrNoOneTimeKeys
 	}
 
 	key := u.keys[0]
 	u.keys = u.keys[1:]
+	u.keyLock.Unlock()
+
+	// Handing out a key that is later handed out again after a restart would
+	// break the session setup of both fetchers, so the removal must stick.
+	if err := u.save(); err != nil {
+		return 0, nil, err
+	}
 	return key.id, key.key, nil
 }
 
@@ -206,75 +271,8 @@ func (u *user) OneTimeKeys() ([]uint64, error) {
 	return arr, nil
 }
 
-func (u *user) pushToLocationBuffer(m msgBox) {
-	u.locationBufferLock.Lock()
-	defer u.locationBufferLock.Unlock()
-
-	for i, mb := range u.locationBuffer {
-		if mb.source == m.source {
-			u.locationBuffer = append(u.locationBuffer[:i], u.locationBuffer[i+1:]...)
-			break
-		}
-	}
-
-	if len(u.locationBuffer) >= UserBufferLimit {
-		limit := len(u.locationBuffer) - UserBufferLimit
-		u.locationBuffer = u.locationBuffer[limit+1:]
-	}
-
-	u.locationBuffer = append(u.locationBuffer, m)
-}
-
-func (u *user) Publish(source string, content []byte) error {
-	m := msgBox{source, content}
-	u.subscriberLock.RLock()
-	defer u.subscriberLock.RUnlock()
-	if len(u.subscribers) == 0 {
-		u.pushToLocationBuffer(m)
-		return nil
-	}
-
-	for _, subscriber := range u.subscribers {
-		subscriber <- m
-	}
-
-	return nil
-}
-
-func (u *user) Subscribe() (<-chan UserMessage, error) {
-	u.locationBufferLock.RLock()
-	defer u.locationBufferLock.RUnlock()
-
-	ch := make(chan UserMessage, len(u.locationBuffer)*2)
-
-	u.subscriberLock.Lock()
-	u.subscribers = append(u.subscribers, ch)
-	u.subscriberLock.Unlock()
-
-	for _, m := range u.locationBuffer {
-		ch <- m
-	}
-
-	u.locationBuffer = nil
-
-	return ch, nil
-}
-
-func (u *user) Unsubscribe(ch <-chan UserMessage) error {
-	u.subscriberLock.Lock()
-	defer u.subscriberLock.Unlock()
-	for i := range u.subscribers {
-		if u.subscribers[i] == ch {
-			close(u.subscribers[i])
-			u.subscribers = append(u.subscribers[:i], u.subscribers[i+1:]...)
-			return nil
-		}
-	}
-
-	return fmt.Errorf("no such subcription")
-}
-
 func newUser(username, password string) (*user, error) {
 	u := &user{username: username}
+	u.addDefaultDevice()
 	return u, u.SetPassword(password)
 }